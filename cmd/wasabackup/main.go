@@ -0,0 +1,126 @@
+/*
+Wasabackup takes hot backups of the WASAText SQLite database, restores them and verifies their integrity.
+The backup is consistent even while `webapi` is running, as it's taken with SQLite `VACUUM INTO`.
+
+Usage:
+
+	wasabackup backup  -db <database file> -out <backup file>
+	wasabackup restore -from <backup file> -db <database file>
+	wasabackup verify  -db <database file>
+
+The commands are:
+
+	backup
+		Copy the database into the backup file. The backup file must not exist (or must be empty).
+
+	restore
+		Check the backup integrity and copy it into the database file. The database file must not exist (or must be
+		empty): stop the server and move away the old database before restoring.
+
+	verify
+		Run `PRAGMA integrity_check` on the database file.
+
+Return values (exit codes):
+
+	0
+		The command was successful
+
+	> 0
+		The command failed (wrong arguments, I/O error, integrity check failed)
+*/
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/flbonanni/WASAText/service/database"
+	_ "github.com/mattn/go-sqlite3"
+	"os"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "error: ", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing command: backup, restore or verify")
+	}
+
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	var dbPath = fs.String("db", "/tmp/decaf.db", "SQLite database file")
+	var out = fs.String("out", "", "backup file to create (backup)")
+	var from = fs.String("from", "", "backup file to restore (restore)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "backup":
+		if *out == "" {
+			return errors.New("-out is required")
+		}
+		src, err := openReadOnly(*dbPath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if err := database.Backup(src, *out); err != nil {
+			return err
+		}
+		return verify(*out)
+
+	case "restore":
+		if *from == "" {
+			return errors.New("-from is required")
+		}
+		src, err := openReadOnly(*from)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if err := database.CheckIntegrity(src); err != nil {
+			return fmt.Errorf("backup %s: %w", *from, err)
+		}
+		if err := database.Backup(src, *dbPath); err != nil {
+			return err
+		}
+		return verify(*dbPath)
+
+	case "verify":
+		return verify(*dbPath)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// verify opens the database file in read-only mode and checks its integrity.
+func verify(path string) error {
+	c, err := openReadOnly(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := database.CheckIntegrity(c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "%s: ok\n", path)
+	return nil
+}
+
+// openReadOnly opens an existing SQLite file without creating it. The busy timeout lets the backup wait for the running
+// server to release its write locks.
+func openReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	c, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("opening SQLite: %w", err)
+	}
+	return c, c.Ping()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupFilePrefix = "wasatext-"
+
+// scheduleBackups copies the database into `dir` every `interval`, keeping only the newest `retention` backups. It
+// returns when ctx is cancelled.
+func scheduleBackups(ctx context.Context, logger logrus.FieldLogger, dbconn *sql.DB, dir string, interval time.Duration, retention int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			name, err := backupOnce(dbconn, dir)
+			if err != nil {
+				logger.WithError(err).Error("scheduled backup failed")
+				continue
+			}
+			logger.WithField("file", name).Info("scheduled backup completed")
+
+			if err := pruneBackups(dir, retention); err != nil {
+				logger.WithError(err).Warning("can't remove old backups")
+			}
+		}
+	}
+}
+
+// backupOnce writes a new backup file in `dir` and checks its integrity.
+func backupOnce(dbconn *sql.DB, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", fmt.Errorf("creating backup directory: %w", err)
+	}
+	name := filepath.Join(dir, backupFilePrefix+globaltime.Now().UTC().Format("20060102T150405Z")+".db")
+	if err := database.Backup(dbconn, name); err != nil {
+		return "", err
+	}
+
+	c, err := sql.Open("sqlite3", "file:"+name+"?mode=ro")
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if err := database.CheckIntegrity(c); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return name, nil
+}
+
+// pruneBackups removes the oldest backups in `dir`, keeping `retention` of them. Backup names contain a sortable
+// timestamp, so the lexical order is the chronological one. A retention <= 0 keeps everything.
+func pruneBackups(dir string, retention int) error {
+	if retention <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), backupFilePrefix) && strings.HasSuffix(e.Name(), ".db") {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > retention {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -27,6 +27,67 @@ type WebAPIConfiguration struct {
 	DB    struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	// Blobs.Directory contains pictures and media (content-addressed). Unreferenced blobs are removed every
+	// Blobs.GCInterval (0 disables the garbage collector) once they are older than Blobs.GCGrace.
+	Blobs struct {
+		Directory  string        `conf:"default:/tmp/wasatext-blobs"`
+		GCInterval time.Duration `conf:"default:1h"`
+		GCGrace    time.Duration `conf:"default:1h"`
+	}
+	// Accounts.DeletedMessages is what happens to the messages of a deleted account: "anonymize" keeps them with a
+	// "deleted user" sender, "delete" removes them.
+	Accounts struct {
+		DeletedMessages string `conf:"default:anonymize"`
+	}
+	// Admin.Users are the usernames of the server administrators (separated by ";" in flags and environment).
+	Admin struct {
+		Users []string
+	}
+	// Retention.Days is the default number of days after which messages are deleted (0 keeps them forever).
+	// Expired messages are deleted every Retention.Interval, at most Retention.Batch per transaction.
+	Retention struct {
+		Days     int           `conf:"default:0"`
+		Interval time.Duration `conf:"default:1h"`
+		Batch    int           `conf:"default:500"`
+	}
+	// Disappearing.Interval is how often the expired disappearing messages are deleted (0 disables the sweeper: expired
+	// messages stay hidden but are not deleted).
+	Disappearing struct {
+		Interval time.Duration `conf:"default:1m"`
+	}
+	// Pins.Max is the maximum number of pinned messages in a conversation.
+	Pins struct {
+		Max int `conf:"default:50"`
+	}
+	// Attachments.MaxFileSize and Attachments.MaxAudioSize are the maximum sizes in bytes of the files of "file" and
+	// "audio" messages. Attachments.Quota is the maximum total size of the files sent by each user (0: no limit).
+	Attachments struct {
+		MaxFileSize  int64 `conf:"default:26214400"`
+		MaxAudioSize int64 `conf:"default:16777216"`
+		Quota        int64 `conf:"default:1073741824"`
+	}
+	// LinkPreview.Enabled turns on the previews of the links sent in text messages. Pages are fetched in background,
+	// within LinkPreview.Timeout and reading at most LinkPreview.MaxSize bytes; results are cached for
+	// LinkPreview.CacheTTL. Private addresses are refused unless listed in LinkPreview.AllowedNetworks (IPs or CIDRs,
+	// separated by ";" in flags and environment).
+	LinkPreview struct {
+		Enabled         bool          `conf:"default:true"`
+		Timeout         time.Duration `conf:"default:5s"`
+		MaxSize         int64         `conf:"default:524288"`
+		CacheTTL        time.Duration `conf:"default:1h"`
+		AllowedNetworks []string
+	}
+	// Export.TTL is how long the user data archives are kept after they have been generated.
+	Export struct {
+		TTL time.Duration `conf:"default:168h"`
+	}
+	// Backup.Interval enables periodic hot backups of the database (0 disables them). Only the newest
+	// Backup.Retention files are kept in Backup.Directory.
+	Backup struct {
+		Directory string        `conf:"default:/tmp/wasatext-backups"`
+		Interval  time.Duration `conf:"default:0s"`
+		Retention int           `conf:"default:7"`
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
@@ -29,8 +29,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/flbonanni/WASAText/service/api"
+	"github.com/flbonanni/WASAText/service/blobstore"
 	"github.com/flbonanni/WASAText/service/database"
 	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/flbonanni/WASAText/service/linkpreview"
 	"github.com/ardanlabs/conf"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -97,6 +99,44 @@ func run() error {
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	// Start periodic backups, if enabled. They must stop before the database is closed.
+	if cfg.Backup.Interval > 0 {
+		logger.Infof("scheduling database backups every %s in %s", cfg.Backup.Interval, cfg.Backup.Directory)
+		backupCtx, stopBackups := context.WithCancel(context.Background())
+		backupDone := make(chan struct{})
+		go func() {
+			scheduleBackups(backupCtx, logger, dbconn, cfg.Backup.Directory, cfg.Backup.Interval, cfg.Backup.Retention)
+			close(backupDone)
+		}()
+		defer func() {
+			stopBackups()
+			<-backupDone
+		}()
+	}
+
+	// Start blob store
+	logger.Println("initializing blob store")
+	blobs, err := blobstore.NewFS(cfg.Blobs.Directory)
+	if err != nil {
+		logger.WithError(err).Error("error creating the blob store")
+		return fmt.Errorf("creating the blob store: %w", err)
+	}
+
+	// Link previews, if enabled
+	var previews *linkpreview.Fetcher
+	if cfg.LinkPreview.Enabled {
+		previews, err = linkpreview.New(linkpreview.Config{
+			Timeout:         cfg.LinkPreview.Timeout,
+			MaxSize:         cfg.LinkPreview.MaxSize,
+			CacheTTL:        cfg.LinkPreview.CacheTTL,
+			AllowedNetworks: cfg.LinkPreview.AllowedNetworks,
+		})
+		if err != nil {
+			logger.WithError(err).Error("error creating the link preview fetcher")
+			return fmt.Errorf("creating the link preview fetcher: %w", err)
+		}
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -111,8 +151,24 @@ func run() error {
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:         logger,
+		Database:       db,
+		Blobs:          blobs,
+		BlobGCInterval: cfg.Blobs.GCInterval,
+		BlobGCGrace:    cfg.Blobs.GCGrace,
+		ExportTTL:      cfg.Export.TTL,
+
+		DeletedUserMessages:  cfg.Accounts.DeletedMessages,
+		Admins:               cfg.Admin.Users,
+		RetentionDays:        cfg.Retention.Days,
+		RetentionInterval:    cfg.Retention.Interval,
+		RetentionBatch:       cfg.Retention.Batch,
+		DisappearingInterval: cfg.Disappearing.Interval,
+		MaxPins:              cfg.Pins.Max,
+		MaxFileSize:          cfg.Attachments.MaxFileSize,
+		MaxAudioSize:         cfg.Attachments.MaxAudioSize,
+		StorageQuota:         cfg.Attachments.Quota,
+		LinkPreviews:         previews,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
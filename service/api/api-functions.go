@@ -8,6 +8,8 @@ import (
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	close(rt.stop)
+	rt.wg.Wait()
 	return nil
 }
 
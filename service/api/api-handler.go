@@ -11,25 +11,76 @@ func (rt *_router) Handler() http.Handler {
 	// User
 	rt.router.GET("/users/:username/profile", rt.wrap(rt.getUserProfile))
 	rt.router.PUT("/users/:username", rt.wrap(rt.setMyUserName))
+	rt.router.DELETE("/users/:username", rt.wrap(rt.deleteUser))
 	// Profile picture
 	rt.router.GET("/users/:username/picture", rt.wrap(rt.getUserPicture))
 	rt.router.PUT("/users/:username/picture", rt.wrap(rt.setMyPhoto))
+	// Export
+	rt.router.POST("/users/:username/export", rt.wrap(rt.requestExport))
+	rt.router.GET("/users/:username/export/:export_id", rt.wrap(rt.getExport))
+	rt.router.GET("/users/:username/export/:export_id/download", rt.wrap(rt.downloadExport))
 	// Conversation
 	rt.router.GET("/users/:username/conversations", rt.wrap(rt.getMyConversations))
+	rt.router.POST("/users/:username/conversations", rt.wrap(rt.createConversation))
 	rt.router.GET("/users/:username/conversations/:conversation_id", rt.wrap(rt.getConversation))
+	rt.router.PUT("/users/:username/conversations/:conversation_id/retention", rt.wrap(rt.setConversationRetention))
+	rt.router.PUT("/users/:username/conversations/:conversation_id/disappearing", rt.wrap(rt.setDisappearingTimer))
+	rt.router.PUT("/users/:username/conversations/:conversation_id/read", rt.wrap(rt.markConversationRead))
+	rt.router.GET("/users/:username/conversations/:conversation_id/draft", rt.wrap(rt.getDraft))
+	rt.router.PUT("/users/:username/conversations/:conversation_id/draft", rt.wrap(rt.saveDraft))
+	rt.router.DELETE("/users/:username/conversations/:conversation_id/draft", rt.wrap(rt.deleteDraft))
 	// Message
+	rt.router.GET("/users/:username/conversations/:conversation_id/messages", rt.wrap(rt.getMessages))
 	rt.router.POST("/users/:username/conversations/:conversation_id/messages", rt.wrap(rt.sendMessage))
 	rt.router.POST("/users/:username/conversations/:conversation_id/messages/:message_id/forward", rt.wrap(rt.forwardMessage))
+	rt.router.GET("/users/:username/conversations/:conversation_id/messages/:message_id/file", rt.wrap(rt.getMessageFile))
 	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id", rt.wrap(rt.deleteMessage))	
+	rt.router.POST("/users/:username/conversations/:conversation_id/messages/:message_id/pin", rt.wrap(rt.pinMessage))
+	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id/pin", rt.wrap(rt.unpinMessage))
+	rt.router.GET("/users/:username/conversations/:conversation_id/pins", rt.wrap(rt.getPins))
+	rt.router.POST("/users/:username/conversations/:conversation_id/messages/:message_id/star", rt.wrap(rt.starMessage))
+	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id/star", rt.wrap(rt.unstarMessage))
+	rt.router.GET("/users/:username/starred", rt.wrap(rt.getStarred))
+	rt.router.PUT("/users/:username/conversations/:conversation_id/messages/:message_id/poll/vote", rt.wrap(rt.votePoll))
+	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id/poll/vote", rt.wrap(rt.retractPollVote))
 	// Comment
 	rt.router.POST("/users/:username/conversations/:conversation_id/messages/:message_id/comments", rt.wrap(rt.commentMessage))
+	rt.router.GET("/users/:username/conversations/:conversation_id/messages/:message_id/comments", rt.wrap(rt.getComments))
 	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id/comments", rt.wrap(rt.uncommentMessage))
+	rt.router.POST("/users/:username/conversations/:conversation_id/messages/:message_id/comments/thread", rt.wrap(rt.replyToMessage))
+	rt.router.GET("/users/:username/conversations/:conversation_id/messages/:message_id/comments/thread", rt.wrap(rt.getThread))
+	rt.router.DELETE("/users/:username/conversations/:conversation_id/messages/:message_id/comments/thread/:reply_id", rt.wrap(rt.deleteThreadReply))
+	rt.router.GET("/users/:username/mentions", rt.wrap(rt.getMentions))
+	rt.router.POST("/users/:username/mentions/read", rt.wrap(rt.markMentionsRead))
 	// Group
+	rt.router.GET("/users/:username/groups", rt.wrap(rt.getMyGroups))
+	rt.router.GET("/users/:username/groups/:group_id", rt.wrap(rt.getGroup))
+	rt.router.GET("/users/:username/groups/:group_id/photo", rt.wrap(rt.getGroupPhoto))
 	rt.router.PUT("/users/:username/groups/:group_id/photo", rt.wrap(rt.setGroupPhoto))
+	rt.router.PUT("/users/:username/groups/:group_id/description", rt.wrap(rt.setGroupDescription))
 	rt.router.PUT("/users/:username/groups/:group_id/name", rt.wrap(rt.setGroupName))
 	rt.router.POST("/users/:username/groups", rt.wrap(rt.createGroup))
 	rt.router.POST("/users/:username/groups/:group_id/members", rt.wrap(rt.addToGroup))
 	rt.router.DELETE("/users/:username/groups/:group_id/members/:member_username", rt.wrap(rt.leaveGroup))
+	rt.router.POST("/users/:username/groups/:group_id/members/:member_username/kick", rt.wrap(rt.kickMember))
+	rt.router.POST("/users/:username/groups/:group_id/members/:member_username/promote", rt.wrap(rt.promoteMember))
+	rt.router.POST("/users/:username/groups/:group_id/members/:member_username/demote", rt.wrap(rt.demoteMember))
+	rt.router.GET("/users/:username/groups/:group_id/permissions", rt.wrap(rt.getGroupPermissions))
+	rt.router.PUT("/users/:username/groups/:group_id/permissions", rt.wrap(rt.setGroupPermissions))
+	rt.router.POST("/users/:username/groups/:group_id/invites", rt.wrap(rt.createGroupInvite))
+	rt.router.GET("/users/:username/groups/:group_id/invites", rt.wrap(rt.getGroupInvites))
+	rt.router.DELETE("/users/:username/groups/:group_id/invites/:token", rt.wrap(rt.revokeGroupInvite))
+	rt.router.GET("/users/:username/groups/:group_id/requests", rt.wrap(rt.getJoinRequests))
+	rt.router.POST("/users/:username/groups/:group_id/requests/:request_id/approve", rt.wrap(rt.approveJoinRequest))
+	rt.router.POST("/users/:username/groups/:group_id/requests/:request_id/reject", rt.wrap(rt.rejectJoinRequest))
+	rt.router.POST("/groups/join/:token", rt.wrap(rt.joinGroup))
+	rt.router.PUT("/users/:username/groups/:group_id/settings", rt.wrap(rt.setGroupSettings))
+	rt.router.GET("/users/:username/groups/:group_id/mutes", rt.wrap(rt.getGroupMutes))
+	rt.router.PUT("/users/:username/groups/:group_id/members/:member_username/mute", rt.wrap(rt.muteMember))
+	rt.router.DELETE("/users/:username/groups/:group_id/members/:member_username/mute", rt.wrap(rt.unmuteMember))
+	rt.router.PUT("/users/:username/groups/:group_id/retention", rt.wrap(rt.setGroupRetention))
+	// Administration
+	rt.router.GET("/admin/retention/report", rt.wrap(rt.getRetentionReport))
 
 	// Special routes
 	rt.router.GET("/liveness", rt.liveness)
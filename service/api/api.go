@@ -11,6 +11,7 @@ Example:
 	apirouter, err := api.New(api.Config{
 		Logger:   logger,
 		Database: appdb,
+		Blobs:    blobs,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -38,10 +39,16 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"github.com/flbonanni/WASAText/service/blobstore"
 	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/linkpreview"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,8 +58,58 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// Blobs is the store for pictures and media. The database keeps only references to blobs.
+	Blobs blobstore.BlobStore
+
+	// BlobGCInterval is the interval between two runs of the blob garbage collector (0 disables it). Unreferenced
+	// blobs younger than BlobGCGrace are kept.
+	BlobGCInterval time.Duration
+	BlobGCGrace    time.Duration
+
+	// DeletedUserMessages is the policy for the messages of deleted accounts: DeletedMessagesDelete removes them,
+	// DeletedMessagesAnonymize keeps them with a "deleted user" sender. The default is DeletedMessagesAnonymize.
+	DeletedUserMessages string
+
+	// Admins are the usernames of the server administrators
+	Admins []string
+
+	// RetentionDays is the default number of days after which messages are deleted (0 keeps them forever). It can be
+	// overridden per conversation or group. The purger runs every RetentionInterval (0 disables it) and deletes at
+	// most RetentionBatch messages per transaction.
+	RetentionDays     int
+	RetentionInterval time.Duration
+	RetentionBatch    int
+
+	// DisappearingInterval is the interval between two runs of the sweeper of disappearing messages (0 disables it).
+	// Expired messages are hidden anyway; the sweeper deletes them, RetentionBatch at a time, with their files.
+	DisappearingInterval time.Duration
+
+	// ExportTTL is how long the user data archives are kept after they have been generated (0 keeps them forever).
+	ExportTTL time.Duration
+
+	// MaxPins is the maximum number of pinned messages in a conversation. The default is 50.
+	MaxPins int
+
+	// MaxFileSize and MaxAudioSize are the maximum sizes of the files of "file" and "audio" messages. The defaults are
+	// 25 MiB and 16 MiB.
+	MaxFileSize  int64
+	MaxAudioSize int64
+
+	// StorageQuota is the maximum total size of the files sent by each user (0: no limit)
+	StorageQuota int64
+
+	// LinkPreviews fetches the previews of the links sent in text messages, after the message has been saved. If nil,
+	// messages have no link preview.
+	LinkPreviews *linkpreview.Fetcher
 }
 
+// Policies for the messages of deleted accounts (Config.DeletedUserMessages)
+const (
+	DeletedMessagesAnonymize = "anonymize"
+	DeletedMessagesDelete    = "delete"
+)
+
 // Router is the package API interface representing an API handler builder
 type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
@@ -71,6 +128,34 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Blobs == nil {
+		return nil, errors.New("blob store is required")
+	}
+	if cfg.RetentionDays < 0 {
+		return nil, errors.New("retention days can't be negative")
+	}
+	if cfg.RetentionBatch <= 0 {
+		cfg.RetentionBatch = 500
+	}
+	if cfg.MaxPins <= 0 {
+		cfg.MaxPins = 50
+	}
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = 25 << 20
+	}
+	if cfg.MaxAudioSize <= 0 {
+		cfg.MaxAudioSize = 16 << 20
+	}
+	if cfg.StorageQuota < 0 {
+		return nil, errors.New("storage quota can't be negative")
+	}
+	switch cfg.DeletedUserMessages {
+	case "":
+		cfg.DeletedUserMessages = DeletedMessagesAnonymize
+	case DeletedMessagesAnonymize, DeletedMessagesDelete:
+	default:
+		return nil, fmt.Errorf("unknown policy for messages of deleted users: %q", cfg.DeletedUserMessages)
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,11 +163,57 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
+	rt := &_router{
 		router:     router,
 		baseLogger: cfg.Logger,
 		db:         cfg.Database,
-	}, nil
+		blobs:      cfg.Blobs,
+		stop:       make(chan struct{}),
+		exportWake: make(chan struct{}, 1),
+		previews:   cfg.LinkPreviews,
+
+		anonymizeDeletedUsers: cfg.DeletedUserMessages == DeletedMessagesAnonymize,
+		admins:                make(map[string]bool),
+		retentionDays:         cfg.RetentionDays,
+		maxPins:               cfg.MaxPins,
+		maxFileSize:           cfg.MaxFileSize,
+		maxAudioSize:          cfg.MaxAudioSize,
+		storageQuota:          cfg.StorageQuota,
+	}
+	for _, admin := range cfg.Admins {
+		rt.admins[admin] = true
+	}
+
+	// Move pictures saved inline by older versions into the blob store
+	migrated, err := rt.db.MigrateInlinePhotos(func(r io.Reader) (string, error) {
+		id, _, err := rt.blobs.Put(r, 0)
+		return id, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("moving pictures into the blob store: %w", err)
+	} else if migrated > 0 {
+		rt.baseLogger.Infof("%d pictures moved into the blob store", migrated)
+	}
+
+	// Start background tasks
+	if cfg.BlobGCInterval > 0 {
+		rt.background(func() { rt.blobGC(cfg.BlobGCInterval, cfg.BlobGCGrace) })
+	}
+	rt.background(func() { rt.exportWorker(cfg.ExportTTL) })
+	if cfg.RetentionInterval > 0 {
+		rt.background(func() { rt.retentionPurger(cfg.RetentionInterval, cfg.RetentionBatch) })
+	}
+	if cfg.DisappearingInterval > 0 {
+		rt.background(func() { rt.disappearingSweeper(cfg.DisappearingInterval, cfg.RetentionBatch, cfg.BlobGCGrace) })
+	}
+	if rt.previews != nil {
+		rt.previewQueue = make(chan linkPreviewJob, linkPreviewQueueSize)
+		for i := 0; i < linkPreviewWorkers; i++ {
+			rt.background(rt.linkPreviewWorker)
+		}
+	}
+
+	return rt, nil
 }
 
 type _router struct {
@@ -93,4 +224,44 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	blobs blobstore.BlobStore
+
+	// stop is closed by Close to ask background goroutines to terminate. wg tracks them.
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// anonymizeDeletedUsers is true if the messages of deleted accounts are kept with a "deleted user" sender
+	anonymizeDeletedUsers bool
+
+	// admins is the set of usernames of the server administrators
+	admins map[string]bool
+
+	// retentionDays is the default message retention (0: messages never expire)
+	retentionDays int
+
+	// maxPins is the maximum number of pinned messages in a conversation
+	maxPins int
+
+	// maxFileSize and maxAudioSize limit the files of messages; storageQuota limits the files sent by each user (0: no
+	// limit)
+	maxFileSize  int64
+	maxAudioSize int64
+	storageQuota int64
+
+	// exportWake wakes up the export worker when a new export is requested
+	exportWake chan struct{}
+
+	// previews fetches link previews (nil if disabled); previewQueue holds the messages waiting for a preview
+	previews     *linkpreview.Fetcher
+	previewQueue chan linkPreviewJob
+}
+
+// background runs fn in a new goroutine tracked by Close. fn must return when rt.stop is closed.
+func (rt *_router) background(fn func()) {
+	rt.wg.Add(1)
+	go func() {
+		defer rt.wg.Done()
+		fn()
+	}()
 }
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/audioinfo"
+	"github.com/flbonanni/WASAText/service/blobstore"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxAttachmentNameLength è la lunghezza massima del nome di un file allegato; i nomi più lunghi vengono accorciati
+const maxAttachmentNameLength = 255
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+var errAttachmentType = errors.New("missing message type before the file")
+var errInvalidAudio = errors.New("invalid audio file")
+
+// storeAttachment legge il body multipart di un messaggio "file" o "audio" e salva il file nel blob store. Il campo
+// `type` deve precedere il campo `file`, così il limite di dimensione è noto prima di ricevere il file. Il file non può
+// superare lo spazio che resta all'utente `userID`; il controllo definitivo della quota lo fa SendMessage, insieme
+// all'inserimento del messaggio, perché più upload in parallelo vedono tutti lo stesso spazio libero.
+func (rt *_router) storeAttachment(r *http.Request, userID uint64) (database.MessageContent, error) {
+	maxBody := rt.maxFileSize
+	if rt.maxAudioSize > maxBody {
+		maxBody = rt.maxAudioSize
+	}
+	limitBody(r, maxBody+maxMultipartOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return database.MessageContent{}, err
+	}
+	msgType := ""
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return database.MessageContent{}, errUploadMissing
+		} else if err != nil {
+			return database.MessageContent{}, err
+		}
+		if part.FileName() == "" {
+			if part.FormName() == "type" {
+				value, err := io.ReadAll(io.LimitReader(part, 16))
+				if err != nil {
+					return database.MessageContent{}, err
+				}
+				msgType = string(value)
+			}
+			_ = part.Close()
+			continue
+		}
+		if part.FormName() != "file" {
+			_ = part.Close()
+			continue
+		}
+
+		var maxSize int64
+		var allowed func(string) bool
+		switch msgType {
+		case database.MessageTypeFile:
+			maxSize, allowed = rt.maxFileSize, func(string) bool { return true }
+		case database.MessageTypeAudio:
+			maxSize, allowed = rt.maxAudioSize, isAudioType
+		default:
+			return database.MessageContent{}, errAttachmentType
+		}
+
+		// se all'utente resta meno spazio del limite, il file non può superare lo spazio che resta
+		quotaLimited := false
+		if rt.storageQuota > 0 {
+			used, err := rt.db.GetUserStorage(userID)
+			if err != nil {
+				return database.MessageContent{}, err
+			}
+			if remaining := rt.storageQuota - used; remaining < maxSize {
+				if remaining <= 0 {
+					return database.MessageContent{}, errQuotaExceeded
+				}
+				maxSize, quotaLimited = remaining, true
+			}
+		}
+
+		uploaded, err := rt.storePart(part, maxSize, allowed)
+		if errors.Is(err, blobstore.ErrBlobTooLarge) && quotaLimited {
+			return database.MessageContent{}, errQuotaExceeded
+		} else if err != nil {
+			return database.MessageContent{}, err
+		}
+
+		file := &database.Attachment{
+			BlobID:      uploaded.BlobID,
+			Name:        attachmentName(uploaded.Filename),
+			Size:        uploaded.Size,
+			ContentType: uploaded.ContentType,
+		}
+		if msgType == database.MessageTypeAudio {
+			if err := rt.readAudioDuration(file); err != nil {
+				return database.MessageContent{}, err
+			}
+		}
+		return database.MessageContent{Type: msgType, File: file}, nil
+	}
+}
+
+// isAudioType dice se il content type rilevato è di un file audio. Per http.DetectContentType i file Ogg sono
+// "application/ogg", qualunque cosa contengano: readAudioDuration accetta poi solo quelli Opus.
+func isAudioType(contentType string) bool {
+	return strings.HasPrefix(contentType, "audio/") || contentType == "application/ogg"
+}
+
+// readAudioDuration legge dal blob store la durata dell'audio. I formati di cui non si sa leggere la durata (es. MP3)
+// restano senza durata, tranne i file Ogg che non sono Opus.
+func (rt *_router) readAudioDuration(file *database.Attachment) error {
+	f, err := rt.blobs.Open(file.BlobID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := audioinfo.Duration(f)
+	switch {
+	case err == nil:
+		file.DurationMs = d.Milliseconds()
+		if file.ContentType == "application/ogg" {
+			file.ContentType = "audio/ogg"
+		}
+	case errors.Is(err, audioinfo.ErrUnsupportedFormat) && file.ContentType == "application/ogg":
+		return errUploadType
+	case errors.Is(err, audioinfo.ErrInvalidFile):
+		return errInvalidAudio
+	case !errors.Is(err, audioinfo.ErrUnsupportedFormat):
+		return err
+	}
+	return nil
+}
+
+// attachmentName ritorna il nome del file inviato dal client senza percorso e senza caratteri di controllo, che
+// finirebbero nell'header Content-Disposition.
+func attachmentName(name string) string {
+	// alcuni browser mandano il percorso completo
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) || isBidiControl(c) {
+			return -1
+		}
+		return c
+	}, strings.ToValidUTF8(name, ""))
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxAttachmentNameLength {
+		name = string([]rune(name)[:maxAttachmentNameLength])
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// attachmentError scrive l'errore HTTP per un errore ritornato da storeAttachment
+func attachmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errQuotaExceeded):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errAttachmentType):
+		http.Error(w, "The type field ('file' or 'audio') must come before the file", http.StatusBadRequest)
+	case errors.Is(err, errInvalidAudio):
+		http.Error(w, "Invalid audio file", http.StatusBadRequest)
+	default:
+		uploadError(w, err)
+	}
+}
+
+// getMessageFile scarica il file di un messaggio "file" o "audio". Sono supportate le richieste Range, così l'audio
+// si può ascoltare senza scaricarlo tutto.
+func (rt *_router) getMessageFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, _, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	msg, err := rt.db.GetMessage(conv.ConversationID, ps.ByName("message_id"))
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file := msg.MessageContent.File
+	if file == nil || file.BlobID == "" {
+		http.Error(w, "The message has no file", http.StatusNotFound)
+		return
+	}
+
+	disposition := "attachment"
+	if msg.MessageContent.Type == database.MessageTypeAudio {
+		disposition = "inline"
+	}
+	if header := mime.FormatMediaType(disposition, map[string]string{"filename": file.Name}); header != "" {
+		disposition = header
+	}
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	rt.serveBlob(w, r, file.BlobID)
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"github.com/flbonanni/WASAText/service/blobstore"
+	"time"
+)
+
+// blobGC periodically removes the blobs that are no longer referenced in the database, until rt.stop is closed.
+func (rt *_router) blobGC(interval time.Duration, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+			refs, err := rt.db.GetBlobReferences()
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("blob gc: can't load blob references")
+				continue
+			}
+			deleted, err := blobstore.CollectGarbage(rt.blobs, refs, grace)
+			if err != nil {
+				rt.baseLogger.WithError(err).Error("blob gc failed")
+			}
+			if deleted > 0 {
+				rt.baseLogger.Infof("blob gc: %d unreferenced blobs removed", deleted)
+			}
+		}
+	}
+}
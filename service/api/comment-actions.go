@@ -2,27 +2,22 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
+// commentMessage aggiunge una reaction a un messaggio. La reaction deve essere una sola emoji; ripetere la stessa
+// reaction non ha effetto.
 func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Verifica autenticazione
-	var user User
-	token := getToken(r.Header.Get("Authorization"))
-	user.ID = token
-	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Verifica autenticazione e partecipazione alla conversazione
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
 		return
 	}
-	user.FromDatabase(dbUser)
-
-	// Estrai parametri dalla URL
-	_ = ps.ByName("username")            // eventuale controllo sulla coerenza con l'utente loggato
-	conversationId := ps.ByName("conversation_id")
 	messageId := ps.ByName("message_id")
 
 	// Decodifica il body in una mappa per ottenere l'emoji
@@ -36,12 +31,17 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 		http.Error(w, "emoji mancante", http.StatusBadRequest)
 		return
 	}
+	if !isSingleEmoji(emoji) {
+		http.Error(w, "The reaction must be a single emoji", http.StatusBadRequest)
+		return
+	}
 
 	// Aggiungi l'emoji reaction al messaggio nel database
-	// (La funzione rt.db.CommentMessage è ipotetica e deve gestire l'associazione tra
-	//  conversationId, messageId, emoji e l'ID dell'utente che aggiunge il commento)
-	err = rt.db.CommentMessage(conversationId, messageId, emoji, user.ID)
-	if err != nil {
+	err := rt.db.CommentMessage(conv.ConversationID, messageId, emoji, user.ID)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -55,30 +55,51 @@ func (rt *_router) commentMessage(w http.ResponseWriter, r *http.Request, ps htt
 	_ = json.NewEncoder(w).Encode(response)
 }
 
+// uncommentMessage toglie la reaction indicata dal parametro `emoji` o, se manca, tutte le reaction dell'utente al
+// messaggio.
 func (rt *_router) uncommentMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Verifica autenticazione
-	var user User
-	// token := getToken(r.Header.Get("Authorization"))
-	username := ps.ByName("username")
-	dbuser, err := rt.db.GetUserId(username)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// Verifica autenticazione e partecipazione alla conversazione
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
 		return
 	}
-	user.FromDatabase(dbuser)
-
-	// Estrai parametri dalla URL
-	_ = ps.ByName("username")            // eventuale controllo sull'utente loggato
-	conversationId := ps.ByName("conversation_id")
 	messageId := ps.ByName("message_id")
+	emoji := r.URL.Query().Get("emoji")
 
 	// Rimuove l'emoji reaction dal messaggio nel database
-	err = rt.db.UncommentMessage(conversationId, messageId, user.ID)
-	if err != nil {
+	err := rt.db.UncommentMessage(conv.ConversationID, messageId, user.ID, emoji)
+	if errors.Is(err, database.ErrCommentDoesNotExist) {
+		http.Error(w, "Reaction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Rispondi con HTTP 204 No Content
 	w.WriteHeader(http.StatusNoContent)
-}
\ No newline at end of file
+}
+
+// getComments elenca chi ha reagito al messaggio e con quale emoji.
+func (rt *_router) getComments(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, _, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	comments, err := rt.db.GetComments(conv.ConversationID, ps.ByName("message_id"))
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if comments == nil {
+		comments = []database.Comment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(comments)
+}
@@ -2,13 +2,27 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
 
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
 	"github.com/flbonanni/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
 )
 
+// Dimensione delle pagine di getMyConversations
+const (
+	defaultConversationPage = 50
+	maxConversationPage     = 100
+)
+
+// conversationPage è una pagina della lista delle conversazioni. NextCursor manca nell'ultima pagina.
+type conversationPage struct {
+	Conversations []database.Conversation `json:"conversations"`
+	NextCursor    string                  `json:"next_cursor,omitempty"`
+}
 
 func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 	var user User
@@ -21,48 +35,173 @@ func (rt *_router) getMyConversations(w http.ResponseWriter, r *http.Request, ps
 	}
 	user.FromDatabase(dbUser)
 
-	username := ps.ByName("username")
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+	limit, ok := pageLimit(w, r, defaultConversationPage, maxConversationPage)
+	if !ok {
+		return
+	}
 
-	// Get the user's conversations from the database
-	conversations, err := rt.db.GetConversations(username)
-	if err != nil {
+	// Get the user's conversations from the database, most recent activity first
+	conversations, next, err := rt.db.GetConversationList(dbUser, r.URL.Query().Get("cursor"), limit)
+	if errors.Is(err, database.ErrInvalidCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	page := conversationPage{Conversations: conversations, NextCursor: next}
+	if page.Conversations == nil {
+		page.Conversations = []database.Conversation{}
+	}
 
 	// Respond with the conversations
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(conversations)
+	_ = json.NewEncoder(w).Encode(page)
 }
 
+// getConversation ritorna una conversazione dell'utente. Chi non ne fa parte la vede come inesistente.
 func (rt *_router) getConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-    // 1) Estrai il token ed esegui l’autenticazione
-    token := getToken(r.Header.Get("Authorization"))
-    user := User{ID: token}
-    dbUser, err := rt.db.CheckUserById(user.ToDatabase())
-    if err != nil {
-        http.Error(w, "User does not exist", http.StatusUnauthorized)
-        return
-    }
-    user.FromDatabase(dbUser)
-
-    // 2) Prendi l’ID della conversazione dai path params
-    conversationID := ps.ByName("conversation_id")
-
-    // 3) Recupera la conversazione
-    conv, err := rt.db.GetConversation(conversationID)
-    if err != nil {
-        if err == database.ErrConversationDoesNotExist {
-            http.Error(w, "Conversation does not exist", http.StatusNotFound)
-        } else {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-        }
+    // 1) Autenticazione e recupero della conversazione, di cui l'utente deve essere partecipante
+    conv, _, ok := rt.loadConversationAsParticipant(w, r, ps)
+    if !ok {
         return
     }
 
-    // 4) Rispondi con la conversazione
+    // 2) Rispondi con la conversazione
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     _ = json.NewEncoder(w).Encode(conv)
-}
\ No newline at end of file
+}
+
+// loadConversationAsParticipant autentica l'utente, controlla che sia quello del path e carica la conversazione del
+// path. A chi non ne fa parte la conversazione risulta inesistente. In caso di errore la risposta è già stata scritta.
+func (rt *_router) loadConversationAsParticipant(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.Conversation, User, bool) {
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return database.Conversation{}, user, false
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return database.Conversation{}, user, false
+	}
+
+	conv, err := rt.db.GetConversation(ps.ByName("conversation_id"))
+	if errors.Is(err, database.ErrConversationDoesNotExist) || (err == nil && !contains(conv.Participants, user.CurrentUsername)) {
+		http.Error(w, "Conversation does not exist", http.StatusNotFound)
+		return database.Conversation{}, user, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return database.Conversation{}, user, false
+	}
+	return conv, user, true
+}
+
+// maxConversationParticipants è il numero massimo di partecipanti di una conversazione creata con createConversation
+const maxConversationParticipants = 50
+
+// createConversation crea una conversazione con gli utenti `participants`, con un ID scelto dal server. Con un solo
+// altro utente ritorna la conversazione diretta tra i due, creandola solo se non esiste ancora, così due client non
+// possono creare due conversazioni per la stessa coppia; con più utenti crea sempre una nuova conversazione.
+func (rt *_router) createConversation(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 2) Partecipanti, senza doppioni; chi crea la conversazione ne fa sempre parte
+	var reqBody struct {
+		Participants []string `json:"participants"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	participants := []string{user.CurrentUsername}
+	for _, p := range reqBody.Participants {
+		if p == "" || strings.Contains(p, ",") {
+			http.Error(w, "Invalid participant", http.StatusBadRequest)
+			return
+		}
+		if !contains(participants, p) {
+			participants = append(participants, p)
+		}
+	}
+	if len(participants) < 2 {
+		http.Error(w, "A conversation needs at least one other participant", http.StatusBadRequest)
+		return
+	}
+	if len(participants) > maxConversationParticipants {
+		http.Error(w, "Too many participants", http.StatusBadRequest)
+		return
+	}
+
+	// 3) Conversazione diretta o nuova conversazione
+	status := http.StatusOK
+	var conv database.Conversation
+	if len(participants) == 2 {
+		conv, err = rt.db.GetOrCreateDirectConversation(participants[0], participants[1])
+	} else {
+		conv, err = rt.db.CreateConversation(participants)
+		status = http.StatusCreated
+	}
+	if errors.Is(err, database.ErrUserDoesNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(conv)
+}
+
+// markConversationRead segna come letti i messaggi della conversazione fino a `message_id` compreso, o fino all'ultimo
+// se il body è vuoto. Il cursore di lettura non torna mai indietro.
+func (rt *_router) markConversationRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if reqBody.MessageID < 0 {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	err := rt.db.MarkConversationRead(user.ID, conv.ConversationID, reqBody.MessageID)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
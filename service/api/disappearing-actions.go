@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// setDisappearingTimer imposta il timer dei messaggi effimeri della conversazione ("off", "1h", "1d" o "7d"): i
+// messaggi inviati da quel momento vengono cancellati allo scadere del timer. Può farlo qualsiasi partecipante; il
+// cambio viene annunciato con un messaggio di sistema.
+func (rt *_router) setDisappearingTimer(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Timer string `json:"timer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || !database.ValidDisappearingTimer(reqBody.Timer) {
+		http.Error(w, "Invalid timer: use 'off', '1h', '1d' or '7d'", http.StatusBadRequest)
+		return
+	}
+
+	err := rt.db.SetDisappearingTimer(conv.ConversationID, user.ToDatabase(), reqBody.Timer)
+	if errors.Is(err, database.ErrConversationDoesNotExist) {
+		http.Error(w, "Conversation does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conv.DisappearingTimer = reqBody.Timer
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(conv)
+}
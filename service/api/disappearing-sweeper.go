@@ -0,0 +1,82 @@
+package api
+
+import (
+	"time"
+
+	"github.com/flbonanni/WASAText/service/blobstore"
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// disappearingSweeper deletes the expired disappearing messages every `interval`, in batches of `batch` messages,
+// until rt.stop is closed. Their files are deleted too, unless they are still referenced or younger than `grace`.
+func (rt *_router) disappearingSweeper(interval time.Duration, batch int, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+			rt.deleteExpiredMessages(batch, grace)
+		}
+	}
+}
+
+// deleteExpiredMessages deletes all the disappearing messages expired now, one transaction per batch, and then the
+// files that no message references anymore
+func (rt *_router) deleteExpiredMessages(batch int, grace time.Duration) {
+	now := globaltime.Now()
+	total := 0
+	var blobs []string
+	for {
+		select {
+		case <-rt.stop:
+			return
+		default:
+		}
+
+		deleted, blobIDs, err := rt.db.DeleteExpiredMessages(now, batch)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("disappearing messages: can't delete expired messages")
+			break
+		}
+		total += deleted
+		blobs = append(blobs, blobIDs...)
+		if deleted < batch {
+			break
+		}
+	}
+	if total > 0 {
+		rt.baseLogger.Infof("disappearing messages: %d expired messages deleted", total)
+	}
+	if len(blobs) == 0 {
+		return
+	}
+
+	// the same file can be in other messages (forwards, or the same content sent again)
+	refs, err := rt.db.GetBlobReferences()
+	if err != nil {
+		rt.baseLogger.WithError(err).Error("disappearing messages: can't load blob references")
+		return
+	}
+	removed := 0
+	for _, id := range blobs {
+		if refs[id] {
+			continue
+		}
+		// a blob refreshed by a new upload may be about to be referenced by a message being sent
+		info, err := rt.blobs.Stat(id)
+		if err != nil || globaltime.Since(info.ModTime) < grace {
+			continue
+		}
+		if err := rt.blobs.Delete(id); err != nil && err != blobstore.ErrBlobDoesNotExist {
+			rt.baseLogger.WithError(err).Error("disappearing messages: can't delete a file")
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		rt.baseLogger.Infof("disappearing messages: %d files deleted", removed)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxDraftLength è la lunghezza massima (in caratteri) di una bozza
+const maxDraftLength = 4096
+
+// getDraft ritorna la bozza dell'utente nella conversazione. Se non c'è la bozza ha il testo vuoto.
+func (rt *_router) getDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	draft, err := rt.db.GetDraft(user.ID, conv.ConversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(draft)
+}
+
+// saveDraft sostituisce la bozza dell'utente nella conversazione. Se il client indica la versione su cui ha lavorato
+// e nel frattempo la bozza è stata cambiata (da un altro client o inviando un messaggio), la bozza non cambia e la
+// risposta è 409 con la bozza attuale; senza versione vince l'ultima scrittura.
+func (rt *_router) saveDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Text    string `json:"text"`
+		Version *int64 `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !utf8.ValidString(reqBody.Text) || utf8.RuneCountInString(reqBody.Text) > maxDraftLength {
+		http.Error(w, "Invalid draft text", http.StatusBadRequest)
+		return
+	}
+
+	draft, err := rt.db.SaveDraft(user.ID, conv.ConversationID, reqBody.Text, reqBody.Version)
+	rt.writeDraftResult(w, draft, err, http.StatusOK)
+}
+
+// deleteDraft cancella la bozza dell'utente nella conversazione. Come per saveDraft, il parametro `version` evita di
+// cancellare una bozza cambiata nel frattempo.
+func (rt *_router) deleteDraft(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var version *int64
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid version", http.StatusBadRequest)
+			return
+		}
+		version = &n
+	}
+
+	draft, err := rt.db.SaveDraft(user.ID, conv.ConversationID, "", version)
+	rt.writeDraftResult(w, draft, err, http.StatusNoContent)
+}
+
+// writeDraftResult scrive la risposta a una modifica della bozza: la bozza con lo stato `status`, oppure 409 con la
+// bozza attuale se il client non aveva l'ultima versione.
+func (rt *_router) writeDraftResult(w http.ResponseWriter, draft database.Draft, err error, status int) {
+	if errors.Is(err, database.ErrDraftConflict) {
+		status = http.StatusConflict
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == http.StatusNoContent {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(draft)
+}
@@ -0,0 +1,107 @@
+package api
+
+import "unicode/utf8"
+
+// maxEmojiRunes limita la lunghezza di una reaction: le sequenze ZWJ più lunghe (famiglie, coppie con i toni della
+// pelle) non superano una decina di rune.
+const maxEmojiRunes = 16
+
+const (
+	zwj            = 0x200D
+	variationText  = 0xFE0E
+	variationEmoji = 0xFE0F
+	keycap         = 0x20E3
+	tagCancel      = 0xE007F
+)
+
+// isSingleEmoji dice se s è un solo grafema emoji: un emoji eventualmente con selettore di variante, tono della pelle
+// o tag, una bandiera (coppia di indicatori regionali), un keycap (1️⃣) o una sequenza ZWJ di questi.
+func isSingleEmoji(s string) bool {
+	if s == "" || !utf8.ValidString(s) || utf8.RuneCountInString(s) > maxEmojiRunes {
+		return false
+	}
+	runes := []rune(s)
+
+	// bandiera: esattamente due indicatori regionali
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	// keycap: cifra, # o *, selettore opzionale, U+20E3
+	if isKeycapBase(runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == variationEmoji {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == keycap
+	}
+
+	// sequenza di emoji uniti da ZWJ, ciascuno con i suoi modificatori
+	i := 0
+	for {
+		if i >= len(runes) || !isEmojiBase(runes[i]) {
+			return false
+		}
+		i++
+		for i < len(runes) && isEmojiModifier(runes[i]) {
+			i++
+		}
+		// tag (bandiere delle suddivisioni, es. 🏴󠁧󠁢󠁳󠁣󠁴󠁿): una serie di tag chiusa da CANCEL TAG
+		if i < len(runes) && isTag(runes[i]) {
+			for i < len(runes) && isTag(runes[i]) && runes[i] != tagCancel {
+				i++
+			}
+			if i >= len(runes) || runes[i] != tagCancel {
+				return false
+			}
+			i++
+		}
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zwj {
+			return false
+		}
+		i++
+	}
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+func isKeycapBase(r rune) bool {
+	return (r >= '0' && r <= '9') || r == '#' || r == '*'
+}
+
+// isEmojiModifier riconosce i selettori di variante e i toni della pelle
+func isEmojiModifier(r rune) bool {
+	return r == variationText || r == variationEmoji || (r >= 0x1F3FB && r <= 0x1F3FF)
+}
+
+func isTag(r rune) bool {
+	return r >= 0xE0020 && r <= 0xE007F
+}
+
+// isEmojiBase approssima la proprietà Extended_Pictographic di Unicode con i blocchi che contengono emoji.
+func isEmojiBase(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF: // simboli, pittogrammi, emoticon, trasporti, supplementari
+		return !isRegionalIndicator(r) && !(r >= 0x1F3FB && r <= 0x1F3FF)
+	case r >= 0x2600 && r <= 0x27BF: // simboli vari, dingbat
+		return true
+	case r >= 0x2300 && r <= 0x23FF: // simboli tecnici (⌚, ⏰, ...)
+		return true
+	case r >= 0x2B00 && r <= 0x2BFF: // frecce e forme (⬆, ⭐, ...)
+		return true
+	case r >= 0x2190 && r <= 0x21FF: // frecce
+		return true
+	case r >= 0x25A0 && r <= 0x25FF: // forme geometriche (▶, ◀, ...)
+		return true
+	}
+	switch r {
+	case 0x00A9, 0x00AE, 0x203C, 0x2049, 0x2122, 0x2139, 0x24C2, 0x2934, 0x2935, 0x3030, 0x303D, 0x3297, 0x3299:
+		return true
+	}
+	return false
+}
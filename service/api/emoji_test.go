@@ -0,0 +1,48 @@
+package api
+
+import "testing"
+
+func TestIsSingleEmoji(t *testing.T) {
+	const zwj = "\u200D"
+	for _, c := range []struct {
+		name  string
+		s     string
+		valid bool
+	}{
+		{"simple", "\U0001F600", true},
+		{"bmp symbol", "\u2764", true},
+		{"variation selector", "\u2764\uFE0F", true},
+		{"skin tone", "\U0001F44D\U0001F3FD", true},
+		{"zwj family", "\U0001F468" + zwj + "\U0001F469" + zwj + "\U0001F467", true},
+		{"zwj with skin tones", "\U0001F9D1\U0001F3FB" + zwj + "\U0001F91D" + zwj + "\U0001F9D1\U0001F3FF", true},
+		{"zwj with variation", "\U0001F3F3\uFE0F" + zwj + "\U0001F308", true},
+		{"flag", "\U0001F1EE\U0001F1F9", true},
+		{"keycap", "1\uFE0F\u20E3", true},
+		{"keycap without selector", "#\u20E3", true},
+		{"tag sequence", "\U0001F3F4\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", true},
+
+		{"empty", "", false},
+		{"plain text", "ok", false},
+		{"letter", "a", false},
+		{"digit", "1", false},
+		{"two emoji", "\U0001F600\U0001F600", false},
+		{"emoji and text", "\U0001F600a", false},
+		{"text and emoji", "a\U0001F600", false},
+		{"two flags", "\U0001F1EE\U0001F1F9\U0001F1EB\U0001F1F7", false},
+		{"single regional indicator", "\U0001F1EE", false},
+		{"keycap without cap", "1\uFE0F", false},
+		{"trailing zwj", "\U0001F468" + zwj, false},
+		{"leading zwj", zwj + "\U0001F468", false},
+		{"double zwj", "\U0001F468" + zwj + zwj + "\U0001F469", false},
+		{"lone skin tone", "\U0001F3FD", false},
+		{"unterminated tags", "\U0001F3F4\U000E0067\U000E0062", false},
+		{"lone tags", "\U000E0067\U000E007F", false},
+		{"invalid utf-8", "\xf0\x9f\x98", false},
+		{"too long", "\U0001F468" + zwj + "\U0001F468" + zwj + "\U0001F468" + zwj + "\U0001F468" + zwj +
+			"\U0001F468" + zwj + "\U0001F468" + zwj + "\U0001F468" + zwj + "\U0001F468" + zwj + "\U0001F468", false},
+	} {
+		if got := isSingleEmoji(c.s); got != c.valid {
+			t.Errorf("%s: isSingleEmoji(%+q) = %v, want %v", c.name, c.s, got, c.valid)
+		}
+	}
+}
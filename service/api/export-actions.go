@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/gofrs/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// downloadWriteTimeout è il tempo massimo per inviare un archivio
+const downloadWriteTimeout = 10 * time.Minute
+
+// requestExport avvia la generazione dell'archivio con i dati dell'utente. Se ce n'è già uno in corso, ritorna quello.
+func (rt *_router) requestExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+
+	// 2) Solo l'utente stesso può esportare i propri dati
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 3) Riusa l'export in corso, oppure ne crea uno nuovo
+	export, err := rt.db.GetPendingExport(user.ID)
+	if errors.Is(err, database.ErrExportDoesNotExist) {
+		exportID, err := uuid.NewV4()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		export = database.Export{
+			ExportID:  exportID.String(),
+			UserID:    user.ID,
+			Status:    database.ExportPending,
+			CreatedAt: globaltime.Now(),
+		}
+		if err := rt.db.CreateExport(export); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rt.wakeExportWorker()
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 4) Risposta 202: l'archivio sarà pronto più tardi
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/users/"+user.CurrentUsername+"/export/"+export.ExportID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(export)
+}
+
+// getExport ritorna lo stato di un export.
+func (rt *_router) getExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	export, ok := rt.loadOwnExport(w, r, ps)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(export)
+}
+
+// downloadExport invia l'archivio ZIP di un export completato.
+func (rt *_router) downloadExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	export, ok := rt.loadOwnExport(w, r, ps)
+	if !ok {
+		return
+	}
+	if export.Status != database.ExportCompleted {
+		http.Error(w, "Export is not ready", http.StatusConflict)
+		return
+	}
+
+	// Un archivio grande può richiedere più del WriteTimeout del server
+	_ = http.NewResponseController(w).SetWriteDeadline(globaltime.Now().Add(downloadWriteTimeout))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="wasatext-export-`+export.ExportID+`.zip"`)
+	rt.serveBlob(w, r, export.BlobID)
+}
+
+// loadOwnExport autentica l'utente e carica l'export richiesto, verificando che appartenga all'utente. In caso di
+// errore scrive la risposta e ritorna false.
+func (rt *_router) loadOwnExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.Export, bool) {
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return database.Export{}, false
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return database.Export{}, false
+	}
+
+	export, err := rt.db.GetExport(ps.ByName("export_id"))
+	if errors.Is(err, database.ErrExportDoesNotExist) || (err == nil && export.UserID != user.ID) {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return export, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return export, false
+	}
+	return export, true
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// exportWorker generates the archives of pending exports, one at a time, until rt.stop is closed. Finished exports
+// older than ttl are deleted (ttl <= 0 keeps them forever).
+func (rt *_router) exportWorker(ttl time.Duration) {
+	if err := rt.db.ResetRunningExports(); err != nil {
+		rt.baseLogger.WithError(err).Error("export: can't reset interrupted exports")
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		rt.runPendingExports()
+		if ttl > 0 {
+			if err := rt.db.DeleteExportsBefore(globaltime.Now().Add(-ttl)); err != nil {
+				rt.baseLogger.WithError(err).Error("export: can't delete expired exports")
+			}
+		}
+
+		select {
+		case <-rt.stop:
+			return
+		case <-rt.exportWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// wakeExportWorker tells the export worker that a new export is waiting. It never blocks.
+func (rt *_router) wakeExportWorker() {
+	select {
+	case rt.exportWake <- struct{}{}:
+	default:
+	}
+}
+
+// runPendingExports processes pending exports until there are none left
+func (rt *_router) runPendingExports() {
+	for {
+		select {
+		case <-rt.stop:
+			return
+		default:
+		}
+
+		e, err := rt.db.ClaimNextExport()
+		if errors.Is(err, database.ErrExportDoesNotExist) {
+			return
+		} else if err != nil {
+			rt.baseLogger.WithError(err).Error("export: can't load pending exports")
+			return
+		}
+
+		logger := rt.baseLogger.WithField("export", e.ExportID)
+		blobID, err := rt.buildExportArchive(e.UserID)
+		now := globaltime.Now()
+		e.CompletedAt = &now
+		if err != nil {
+			logger.WithError(err).Error("export failed")
+			e.Status = database.ExportFailed
+			e.Error = err.Error()
+		} else {
+			logger.Info("export completed")
+			e.Status = database.ExportCompleted
+			e.BlobID = blobID
+		}
+		if err := rt.db.UpdateExport(e); err != nil {
+			logger.WithError(err).Error("export: can't save the export status")
+		}
+	}
+}
+
+// buildExportArchive writes the ZIP archive with the data of the user in the blob store, and returns its blob ID. The
+// archive contains one JSON file for each kind of data, and the media files in `media/`.
+func (rt *_router) buildExportArchive(userID uint64) (string, error) {
+	data, err := rt.db.GetUserData(userID)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp("", "wasatext-export-*.zip")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	zw := zip.NewWriter(tmp)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", data.Profile},
+		{"conversations.json", data.Conversations},
+		{"messages.json", data.Messages},
+		{"reactions.json", data.Reactions},
+		{"groups.json", data.Groups},
+	}
+	for _, f := range files {
+		fw, err := createZipEntry(zw, f.name)
+		if err != nil {
+			return "", err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.content); err != nil {
+			return "", err
+		}
+	}
+
+	// Media: foto profilo e foto dei gruppi amministrati
+	if data.Profile.PhotoID != "" {
+		if err := rt.addBlobToZip(zw, "media/profile-photo", data.Profile.PhotoID); err != nil {
+			return "", err
+		}
+	}
+	for _, g := range data.Groups {
+		if g.PhotoID != "" {
+			if err := rt.addBlobToZip(zw, "media/groups/"+g.GroupID, g.PhotoID); err != nil {
+				return "", err
+			}
+		}
+	}
+	// file dei messaggi inviati, con il loro nome preceduto dall'ID del messaggio
+	for _, m := range data.Messages {
+		if f := m.MessageContent.File; f != nil && f.BlobID != "" {
+			if err := rt.copyBlobToZip(zw, fmt.Sprintf("media/messages/%d-%s", m.ID, f.Name), f.BlobID); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	id, _, err := rt.blobs.Put(tmp, 0)
+	return id, err
+}
+
+// addBlobToZip copies the blob `id` in the archive as `name`, with the extension of its content type
+func (rt *_router) addBlobToZip(zw *zip.Writer, name string, id string) error {
+	f, err := rt.blobs.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if exts, _ := mime.ExtensionsByType(http.DetectContentType(head[:n])); len(exts) > 0 {
+		name += exts[0]
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	fw, err := createZipEntry(zw, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// copyBlobToZip copies the blob `id` in the archive as `name`
+func (rt *_router) copyBlobToZip(zw *zip.Writer, name string, id string) error {
+	f, err := rt.blobs.Open(id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fw, err := createZipEntry(zw, name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// createZipEntry adds a compressed file to the archive, dated now
+func createZipEntry(zw *zip.Writer, name string) (io.Writer, error) {
+	return zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: globaltime.Now(),
+	})
+}
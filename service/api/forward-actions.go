@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxForwardTargets è il numero massimo di destinazioni di un forward
+const maxForwardTargets = 20
+
+// forwardTarget è una destinazione di un forward: una conversazione, oppure un utente a cui il messaggio arriva nella
+// conversazione diretta, creata se non esiste ancora
+type forwardTarget struct {
+	ConversationID string `json:"conversation_id,omitempty"`
+	Username       string `json:"username,omitempty"`
+}
+
+// forwardResult è l'esito del forward verso una destinazione. Status è il codice HTTP che avrebbe avuto il forward
+// verso quella sola destinazione.
+type forwardResult struct {
+	Target         forwardTarget     `json:"target"`
+	ConversationID string            `json:"conversation_id,omitempty"`
+	Status         int               `json:"status"`
+	Error          string            `json:"error,omitempty"`
+	Denied         *postDenied       `json:"denied,omitempty"`
+	Message        *database.Message `json:"message,omitempty"`
+}
+
+// forwardMessage inoltra un messaggio in una o più conversazioni. Con `targets` la risposta contiene l'esito per ogni
+// destinazione; con la sola target_conversation_id (o recipient_username) la risposta è il messaggio inoltrato.
+func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// Si possono inoltrare solo i messaggi delle conversazioni di cui si è partecipanti
+	source, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Targets              []forwardTarget `json:"targets"`
+		TargetConversationID string          `json:"target_conversation_id"`
+		RecipientUsername    string          `json:"recipient_username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	messageID := ps.ByName("message_id")
+	msg, err := rt.db.GetMessage(source.ConversationID, messageID)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg.MessageContent.Type == database.MessageTypeSystem {
+		http.Error(w, "System messages cannot be forwarded", http.StatusForbidden)
+		return
+	}
+
+	done := make(map[string]*database.Message)
+	if len(reqBody.Targets) == 0 {
+		target := forwardTarget{ConversationID: reqBody.TargetConversationID}
+		if target.ConversationID == "" {
+			target.Username = reqBody.RecipientUsername
+		}
+		res := rt.forwardTo(source, messageID, target, user, done)
+		switch {
+		case res.Denied != nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(res.Denied)
+		case res.Message != nil:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(res.Message)
+		default:
+			http.Error(w, res.Error, res.Status)
+		}
+		return
+	}
+	if len(reqBody.Targets) > maxForwardTargets {
+		http.Error(w, "Too many forward targets", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]forwardResult, 0, len(reqBody.Targets))
+	for _, target := range reqBody.Targets {
+		results = append(results, rt.forwardTo(source, messageID, target, user, done))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// forwardTo inoltra il messaggio `messageID` della conversazione `source` verso una destinazione. `done` contiene i
+// messaggi già inoltrati in questa richiesta, per conversazione: una conversazione indicata due volte (es. per ID e
+// per username) riceve il messaggio una volta sola.
+func (rt *_router) forwardTo(source database.Conversation, messageID string, target forwardTarget, user User, done map[string]*database.Message) forwardResult {
+	res := forwardResult{Target: target}
+	fail := func(status int, message string) forwardResult {
+		res.Status, res.Error = status, message
+		return res
+	}
+
+	var conv database.Conversation
+	var err error
+	switch {
+	case target.ConversationID != "" && target.Username != "":
+		return fail(http.StatusBadRequest, "A forward target must have either a conversation_id or a username")
+	case target.ConversationID != "":
+		conv, err = rt.db.GetConversation(target.ConversationID)
+		if errors.Is(err, database.ErrConversationDoesNotExist) {
+			return fail(http.StatusNotFound, "Conversation does not exist")
+		}
+	case target.Username == user.CurrentUsername:
+		return fail(http.StatusBadRequest, "You can't forward a message to yourself")
+	case target.Username != "":
+		conv, err = rt.db.GetOrCreateDirectConversation(user.CurrentUsername, target.Username)
+		if errors.Is(err, database.ErrUserDoesNotExist) {
+			return fail(http.StatusNotFound, "User does not exist")
+		}
+	default:
+		return fail(http.StatusBadRequest, "Missing forward target")
+	}
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	res.ConversationID = conv.ConversationID
+
+	if m, ok := done[conv.ConversationID]; ok {
+		res.Status, res.Message = http.StatusOK, m
+		return res
+	}
+
+	// Si può inoltrare solo in conversazioni in cui si può scrivere
+	denied, err := rt.postDenial(conv, user)
+	if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	if denied != nil {
+		res.Denied = denied
+		return fail(http.StatusForbidden, denied.Message)
+	}
+
+	forwarded, err := rt.db.ForwardMessage(source.ConversationID, messageID, conv.ConversationID, user.ID, rt.storageQuota)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		return fail(http.StatusNotFound, "Message not found")
+	} else if errors.Is(err, database.ErrSystemMessage) {
+		return fail(http.StatusForbidden, "System messages cannot be forwarded")
+	} else if errors.Is(err, database.ErrStorageQuotaExceeded) {
+		return fail(http.StatusRequestEntityTooLarge, "Storage quota exceeded")
+	} else if err != nil {
+		return fail(http.StatusInternalServerError, err.Error())
+	}
+	rt.queueLinkPreview(conv.ConversationID, forwarded)
+
+	done[conv.ConversationID] = &forwarded
+	res.Status, res.Message = http.StatusOK, &forwarded
+	return res
+}
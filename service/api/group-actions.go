@@ -2,26 +2,25 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
     "github.com/flbonanni/WASAText/service/database"
 	"github.com/julienschmidt/httprouter"
-    "strconv"
-    "fmt"
 )
 
 func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-    token := getToken(r.Header.Get("Authorization"))
-    var requestUser User
-    requestUser.ID = token
-    user, err := rt.db.CheckUserById(requestUser.ToDatabase())
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusUnauthorized)
+    group, user, ok := rt.loadGroupAsMember(w, r, ps)
+    if !ok {
+        return
+    }
+    if !group.Can(user.CurrentUsername, group.Permissions.Rename) {
+        http.Error(w, "Unauthorized action", http.StatusForbidden)
         return
     }
 
-    groupId := ps.ByName("group_id")
 	// ogni campo è una coppia chiave/valore di tipo stringa
     var reqBody map[string]string
     if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
@@ -37,7 +36,7 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
         return
     }
 
-    if err := rt.db.UpdateGroupName(groupId, user.ID, groupName); err != nil {
+    if err := rt.db.UpdateGroupName(group.GroupID, user.ToDatabase(), groupName); err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
@@ -48,31 +47,23 @@ func (rt *_router) setGroupName(w http.ResponseWriter, r *http.Request, ps httpr
 }
 
 func (rt *_router) setGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	var requestuser User
-	token := getToken(r.Header.Get("Authorization"))
-	requestuser.ID = token
-
-	user, err := rt.db.CheckUserById(requestuser.ToDatabase())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
 		return
 	}
-
-	err = r.ParseMultipartForm(10 << 20) 
-	if err != nil {
-		http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
+	if !group.Can(user.CurrentUsername, group.Permissions.ChangePhoto) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
 		return
 	}
 
-	groupId := ps.ByName("group_id")
-	file, _, err := r.FormFile("photo")
+	// La foto viene salvata nel blob store mentre arriva; nel DB va solo il riferimento
+	uploaded, err := rt.storeUpload(r, "photo", maxPhotoSize, "image/")
 	if err != nil {
-		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+		uploadError(w, err)
 		return
 	}
-	defer file.Close()
 
-	err = rt.db.UpdateGroupPhoto(groupId, user.ID, file)
+	err = rt.db.UpdateGroupPhoto(group.GroupID, user.ToDatabase(), uploaded.BlobID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -103,13 +94,33 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
         return
     }
     
+    if len(reqBody.GroupName) < 3 || len(reqBody.GroupName) > 50 {
+        http.Error(w, "Invalid group name", http.StatusBadRequest)
+        return
+    }
+
+    // I membri sono gli username, creatore compreso: diventano i partecipanti della conversazione del gruppo
+    members := []string{user.CurrentUsername}
+    for _, m := range reqBody.Members {
+        if strings.Contains(m, ",") {
+            http.Error(w, "Invalid member username", http.StatusBadRequest)
+            return
+        }
+        if m != "" && !contains(members, m) {
+            members = append(members, m)
+        }
+    }
+
     groupId, err := rt.db.CreateGroup(
         user.ID,
         reqBody.GroupName,
         reqBody.Description,
-        append(reqBody.Members, strconv.FormatUint(user.ID, 10)),
+        members,
     )
-    if err != nil {
+    if errors.Is(err, database.ErrUserDoesNotExist) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    } else if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
@@ -120,28 +131,16 @@ func (rt *_router) createGroup(w http.ResponseWriter, r *http.Request, ps httpro
 }
 
 func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-    // 1) Estraggo token e costruisco user
-    token := getToken(r.Header.Get("Authorization"))
-    user := User{ID: token}
-
-    // 2) Verifico che esista nel DB
-    dbUser, err := rt.db.CheckUserById(user.ToDatabase())
-    if err != nil {
-        http.Error(w, "User does not exist", http.StatusUnauthorized)
+    // 1) Autenticazione e gruppo: l'utente deve essere un membro con il permesso di aggiungere membri
+    group, user, ok := rt.loadGroupAsMember(w, r, ps)
+    if !ok {
         return
     }
-    user.FromDatabase(dbUser)
-
-    // (Facoltativo) Controlla che il path param username corrisponda
-    usernameParam := ps.ByName("username")
-    if usernameParam != user.CurrentUsername {
-        http.Error(w, "username mismatch", http.StatusForbidden)
+    if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+        http.Error(w, "Unauthorized action", http.StatusForbidden)
         return
     }
 
-    // 3) Leggo il group_id
-    groupID := ps.ByName("group_id")
-
     // 4) Decodifico il body
     var reqBody struct {
         NewMemberUsername string `json:"new_member_username"`
@@ -151,18 +150,20 @@ func (rt *_router) addToGroup(w http.ResponseWriter, r *http.Request, ps httprou
         return
     }
     newMember := reqBody.NewMemberUsername
-    if len(newMember) < 3 || len(newMember) > 30 {
+    if len(newMember) < 3 || len(newMember) > 30 || strings.Contains(newMember, ",") {
         http.Error(w, "Invalid member username", http.StatusBadRequest)
         return
     }
 
     // 5) Invoco il DB
-    if err := rt.db.AddMemberToGroup(groupID, user.ID, newMember); err != nil {
-        switch err {
-        case database.ErrGroupNotFound:
+    if err := rt.db.AddMemberToGroup(group.GroupID, user.ToDatabase(), newMember); err != nil {
+        switch {
+        case errors.Is(err, database.ErrGroupNotFound):
             http.Error(w, "Group not found", http.StatusNotFound)
-        case fmt.Errorf("member already exists"):
+        case errors.Is(err, database.ErrMemberAlreadyExists):
             http.Error(w, "Member already exists", http.StatusConflict)
+        case errors.Is(err, database.ErrUserDoesNotExist):
+            http.Error(w, "User does not exist", http.StatusNotFound)
         default:
             http.Error(w, err.Error(), http.StatusInternalServerError)
         }
@@ -199,11 +200,11 @@ func (rt *_router) leaveGroup(w http.ResponseWriter, r *http.Request, ps httprou
     }
 
     // 4) Rimuovi il membro
-    if err := rt.db.RemoveMemberFromGroup(groupId, memberUsername); err != nil {
+    if err := rt.db.RemoveMemberFromGroup(groupId, dbUser, memberUsername); err != nil {
         switch err {
         case database.ErrGroupNotFound:
             http.Error(w, "Group not found", http.StatusNotFound)
-        case fmt.Errorf("member not found in group"):
+        case database.ErrMemberNotFound:
             http.Error(w, "Member not in group", http.StatusNotFound)
         default:
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxGroupDescriptionLength è la lunghezza massima della descrizione di un gruppo
+const maxGroupDescriptionLength = 500
+
+// getMyGroups ritorna i gruppi di cui fa parte l'utente.
+func (rt *_router) getMyGroups(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 2) Lettura
+	dbGroups, err := rt.db.GetGroupsOfUser(user.CurrentUsername)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups := make([]Group, 0, len(dbGroups))
+	for _, g := range dbGroups {
+		var group Group
+		group.FromDatabase(g)
+		groups = append(groups, group)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(groups)
+}
+
+// getGroup ritorna nome, descrizione, membri, ruoli e permessi di un gruppo.
+func (rt *_router) getGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	dbGroup, _, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	var group Group
+	group.FromDatabase(dbGroup)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(group)
+}
+
+// getGroupPhoto ritorna la foto del gruppo dal blob store.
+func (rt *_router) getGroupPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, _, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if group.PhotoID == "" {
+		http.Error(w, "Group has no photo", http.StatusNotFound)
+		return
+	}
+	rt.serveBlob(w, r, group.PhotoID)
+}
+
+// setGroupDescription cambia la descrizione del gruppo, con lo stesso permesso del nome; una descrizione vuota la
+// rimuove.
+func (rt *_router) setGroupDescription(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.Rename) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	var reqBody struct {
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Description == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(*reqBody.Description)) > maxGroupDescriptionLength {
+		http.Error(w, "Invalid group description", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.db.UpdateGroupDescription(group.GroupID, user.ToDatabase(), *reqBody.Description); errors.Is(err, database.ErrGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": "Group description updated successfully."})
+}
+
+// loadGroupAsMember autentica l'utente e carica il gruppo del path. Se l'utente non è membro il gruppo risulta
+// inesistente, così non si rivela nulla dei gruppi altrui. In caso di errore la risposta è già stata scritta.
+func (rt *_router) loadGroupAsMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.Group, User, bool) {
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return database.Group{}, user, false
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return database.Group{}, user, false
+	}
+
+	group, err := rt.db.GetGroup(ps.ByName("group_id"))
+	if errors.Is(err, database.ErrGroupNotFound) || (err == nil && !contains(group.Members, user.CurrentUsername)) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return database.Group{}, user, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return database.Group{}, user, false
+	}
+	return group, user, true
+}
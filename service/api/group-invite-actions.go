@@ -0,0 +1,231 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxInviteUses è il limite massimo che si può dare agli usi di un invito
+const maxInviteUses = 10000
+
+// newInviteToken genera un token casuale da usare nei link di invito. Chi conosce il token può entrare nel gruppo,
+// quindi non deve essere indovinabile.
+func newInviteToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// createGroupInvite crea un link di invito al gruppo. Serve il permesso AddMembers.
+func (rt *_router) createGroupInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	var reqBody struct {
+		ExpiresAt        *time.Time `json:"expires_at"`
+		MaxUses          int        `json:"max_uses"`
+		RequiresApproval bool       `json:"requires_approval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	now := globaltime.Now()
+	if reqBody.MaxUses < 0 || reqBody.MaxUses > maxInviteUses || (reqBody.ExpiresAt != nil && !reqBody.ExpiresAt.After(now)) {
+		http.Error(w, "Invalid invite", http.StatusBadRequest)
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invite := database.GroupInvite{
+		Token:            token,
+		GroupID:          group.GroupID,
+		CreatedBy:        user.ID,
+		CreatedAt:        now,
+		ExpiresAt:        reqBody.ExpiresAt,
+		MaxUses:          reqBody.MaxUses,
+		RequiresApproval: reqBody.RequiresApproval,
+	}
+	if err := rt.db.CreateGroupInvite(invite); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/groups/join/"+token)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(invite)
+}
+
+// getGroupInvites elenca gli inviti del gruppo, anche quelli scaduti o esauriti. Serve il permesso AddMembers.
+func (rt *_router) getGroupInvites(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	invites, err := rt.db.GetGroupInvites(group.GroupID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if invites == nil {
+		invites = []database.GroupInvite{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(invites)
+}
+
+// revokeGroupInvite cancella un invito. Serve il permesso AddMembers.
+func (rt *_router) revokeGroupInvite(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	if err := rt.db.DeleteGroupInvite(group.GroupID, ps.ByName("token")); errors.Is(err, database.ErrInviteDoesNotExist) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// joinGroup usa un link di invito: l'utente entra nel gruppo oppure, se l'invito richiede approvazione, resta in
+// attesa che un admin accetti la richiesta.
+func (rt *_router) joinGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+
+	// 2) Uso dell'invito
+	groupId, pending, err := rt.db.JoinGroupWithInvite(ps.ByName("token"), dbUser, globaltime.Now())
+	switch {
+	case errors.Is(err, database.ErrInviteDoesNotExist), errors.Is(err, database.ErrGroupNotFound):
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrInviteExpired):
+		http.Error(w, "Invite expired", http.StatusGone)
+		return
+	case errors.Is(err, database.ErrMemberAlreadyExists):
+		http.Error(w, "Already a member of the group", http.StatusConflict)
+		return
+	case errors.Is(err, database.ErrJoinRequestExists):
+		http.Error(w, "Join request already pending", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// 3) Risposta: 202 se la richiesta aspetta un admin
+	status, code := "joined", http.StatusOK
+	if pending {
+		status, code = "pending", http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"group_id": groupId, "status": status})
+}
+
+// getJoinRequests elenca le richieste di ingresso in attesa. Serve il permesso AddMembers.
+func (rt *_router) getJoinRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	requests, err := rt.db.GetJoinRequests(group.GroupID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if requests == nil {
+		requests = []database.JoinRequest{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(requests)
+}
+
+// approveJoinRequest accetta una richiesta di ingresso: il richiedente diventa membro.
+func (rt *_router) approveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.resolveJoinRequest(w, r, ps, true)
+}
+
+// rejectJoinRequest rifiuta una richiesta di ingresso.
+func (rt *_router) rejectJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.resolveJoinRequest(w, r, ps, false)
+}
+
+func (rt *_router) resolveJoinRequest(w http.ResponseWriter, r *http.Request, ps httprouter.Params, approve bool) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.AddMembers) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+	requestID, err := strconv.ParseInt(ps.ByName("request_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	}
+
+	if err := rt.db.ResolveJoinRequest(group.GroupID, user.ToDatabase(), requestID, approve); errors.Is(err, database.ErrJoinRequestDoesNotExist) {
+		http.Error(w, "Join request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Codici del motivo per cui un utente non può scrivere in una conversazione, restituiti nel campo "reason" del 403
+const (
+	postDeniedNotParticipant   = "not_participant"
+	postDeniedAnnouncementOnly = "announcement_only"
+	postDeniedMuted            = "muted"
+)
+
+// postDenied è il corpo del 403 quando un utente non può scrivere in una conversazione
+type postDenied struct {
+	Reason     string     `json:"reason"`
+	Message    string     `json:"message"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+}
+
+// checkCanPost verifica che l'utente possa scrivere nella conversazione: deve esserne partecipante e, nei gruppi, non
+// deve essere silenziato né, se il gruppo è solo per annunci, un semplice membro. Se non può, scrive il 403 e ritorna
+// false.
+func (rt *_router) checkCanPost(w http.ResponseWriter, conv database.Conversation, user User) bool {
+	denied, err := rt.postDenial(conv, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if denied != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_ = json.NewEncoder(w).Encode(denied)
+		return false
+	}
+	return true
+}
+
+// postDenial ritorna il motivo per cui l'utente non può scrivere nella conversazione, o nil se può (vedi checkCanPost).
+func (rt *_router) postDenial(conv database.Conversation, user User) (*postDenied, error) {
+	if !contains(conv.Participants, user.CurrentUsername) {
+		return &postDenied{Reason: postDeniedNotParticipant, Message: "You are not a participant of this conversation"}, nil
+	}
+	if !conv.IsGroup {
+		return nil, nil
+	}
+
+	group, err := rt.db.GetGroup(conv.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if group.AnnouncementOnly && !group.Can(user.CurrentUsername, database.RoleAdmin) {
+		return &postDenied{Reason: postDeniedAnnouncementOnly, Message: "Only admins can send messages in this group"}, nil
+	}
+	mute, err := rt.db.GetActiveMute(group.GroupID, user.ID, globaltime.Now())
+	if err == nil {
+		return &postDenied{Reason: postDeniedMuted, Message: "You are muted in this group", MutedUntil: mute.ExpiresAt}, nil
+	} else if !errors.Is(err, database.ErrMuteDoesNotExist) {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// setGroupSettings cambia le impostazioni del gruppo. Per ora c'è solo announcement_only; possono cambiarla owner e
+// admin.
+func (rt *_router) setGroupSettings(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if !group.Can(user.CurrentUsername, database.RoleAdmin) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	var reqBody struct {
+		AnnouncementOnly *bool `json:"announcement_only"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.AnnouncementOnly == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := rt.db.SetGroupAnnouncementOnly(group.GroupID, user.ToDatabase(), *reqBody.AnnouncementOnly); errors.Is(err, database.ErrGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]bool{"announcement_only": *reqBody.AnnouncementOnly})
+}
+
+// getGroupMutes elenca i membri silenziati in questo momento.
+func (rt *_router) getGroupMutes(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, _, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	mutes, err := rt.db.GetGroupMutes(group.GroupID, globaltime.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mutes == nil {
+		mutes = []database.GroupMute{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(mutes)
+}
+
+// muteMember impedisce a un membro di scrivere, fino a expires_at o finché non viene tolto il mute. Come per la
+// rimozione, serve il permesso RemoveMembers e un ruolo superiore a quello del membro.
+func (rt *_router) muteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadModerationTarget(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	now := globaltime.Now()
+	if reqBody.ExpiresAt != nil && !reqBody.ExpiresAt.After(now) {
+		http.Error(w, "Invalid expiry", http.StatusBadRequest)
+		return
+	}
+
+	member := ps.ByName("member_username")
+	if err := rt.db.MuteGroupMember(group.GroupID, member, user.ToDatabase(), reqBody.ExpiresAt, now); errors.Is(err, database.ErrGroupNotFound) || errors.Is(err, database.ErrMemberNotFound) {
+		http.Error(w, "Member not in group", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unmuteMember toglie il mute a un membro, con gli stessi permessi di muteMember.
+func (rt *_router) unmuteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadModerationTarget(w, r, ps)
+	if !ok {
+		return
+	}
+
+	member := ps.ByName("member_username")
+	if err := rt.db.UnmuteGroupMember(group.GroupID, member, user.ToDatabase(), globaltime.Now()); errors.Is(err, database.ErrMuteDoesNotExist) {
+		http.Error(w, "Member is not muted", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadModerationTarget carica il gruppo e verifica che l'utente possa moderare il membro del path: serve il permesso
+// RemoveMembers e un ruolo superiore. In caso di errore la risposta è già stata scritta.
+func (rt *_router) loadModerationTarget(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.Group, User, bool) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return group, user, false
+	}
+	member := ps.ByName("member_username")
+	if group.RoleOf(member) == "" {
+		http.Error(w, "Member not in group", http.StatusNotFound)
+		return group, user, false
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.RemoveMembers) || !group.Outranks(user.CurrentUsername, member) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return group, user, false
+	}
+	return group, user, true
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// promoteMember alza di un livello il ruolo di un membro: member → admin → owner. Solo gli owner possono farlo.
+func (rt *_router) promoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, map[string]string{
+		database.RoleMember: database.RoleAdmin,
+		database.RoleAdmin:  database.RoleOwner,
+	})
+}
+
+// demoteMember abbassa di un livello il ruolo di un membro: owner → admin → member. Solo gli owner possono farlo, anche
+// su se stessi, purché resti almeno un owner.
+func (rt *_router) demoteMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	rt.changeMemberRole(w, r, ps, map[string]string{
+		database.RoleOwner: database.RoleAdmin,
+		database.RoleAdmin: database.RoleMember,
+	})
+}
+
+// changeMemberRole porta il membro del path dal suo ruolo attuale a next[ruolo attuale]; se il ruolo non è in next il
+// membro è già al livello massimo (o minimo) e la richiesta è in conflitto.
+func (rt *_router) changeMemberRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params, next map[string]string) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if group.RoleOf(user.CurrentUsername) != database.RoleOwner {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	member := ps.ByName("member_username")
+	current := group.RoleOf(member)
+	if current == "" {
+		http.Error(w, "Member not in group", http.StatusNotFound)
+		return
+	}
+	role, ok := next[current]
+	if !ok {
+		http.Error(w, "Member is already "+current, http.StatusConflict)
+		return
+	}
+
+	if err := rt.db.SetGroupRole(group.GroupID, member, role); err != nil {
+		switch {
+		case errors.Is(err, database.ErrLastOwner):
+			http.Error(w, "The group must have at least one owner", http.StatusConflict)
+		case errors.Is(err, database.ErrGroupNotFound), errors.Is(err, database.ErrMemberNotFound):
+			http.Error(w, "Member not in group", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{"username": member, "role": role})
+}
+
+// kickMember rimuove un altro membro dal gruppo. Serve il permesso RemoveMembers e un ruolo superiore a quello del
+// membro rimosso; per uscire dal gruppo si usa leaveGroup.
+func (rt *_router) kickMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+
+	member := ps.ByName("member_username")
+	if member == user.CurrentUsername {
+		http.Error(w, "Use leave to exit the group", http.StatusBadRequest)
+		return
+	}
+	if group.RoleOf(member) == "" {
+		http.Error(w, "Member not in group", http.StatusNotFound)
+		return
+	}
+	if !group.Can(user.CurrentUsername, group.Permissions.RemoveMembers) || !group.Outranks(user.CurrentUsername, member) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	if err := rt.db.RemoveMemberFromGroup(group.GroupID, user.ToDatabase(), member); err != nil {
+		switch {
+		case errors.Is(err, database.ErrGroupNotFound), errors.Is(err, database.ErrMemberNotFound):
+			http.Error(w, "Member not in group", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getGroupPermissions ritorna la matrice dei permessi del gruppo.
+func (rt *_router) getGroupPermissions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, _, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	var perm GroupPermissions
+	perm.FromDatabase(group.Permissions)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(perm)
+}
+
+// setGroupPermissions sostituisce la matrice dei permessi del gruppo. Solo gli owner possono farlo.
+func (rt *_router) setGroupPermissions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	group, user, ok := rt.loadGroupAsMember(w, r, ps)
+	if !ok {
+		return
+	}
+	if group.RoleOf(user.CurrentUsername) != database.RoleOwner {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	var perm GroupPermissions
+	if err := json.NewDecoder(r.Body).Decode(&perm); err != nil || !perm.ToDatabase().Valid() {
+		http.Error(w, "Invalid permissions", http.StatusBadRequest)
+		return
+	}
+	if err := rt.db.UpdateGroupPermissions(group.GroupID, perm.ToDatabase()); errors.Is(err, database.ErrGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(perm)
+}
@@ -10,4 +10,14 @@ func getToken(message string) uint64 {
 	stringToken := re.FindAllString(message, -1)
 	token, _ := strconv.Atoi(stringToken[0])
 	return uint64(token)
-}
\ No newline at end of file
+}
+
+// contains reports whether list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
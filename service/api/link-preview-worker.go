@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/linkpreview"
+)
+
+// Number of link preview workers and of messages that can wait for a preview
+const (
+	linkPreviewWorkers   = 2
+	linkPreviewQueueSize = 100
+)
+
+// linkPreviewJob is a message waiting for the preview of a link in its text
+type linkPreviewJob struct {
+	conversationID string
+	messageID      int
+	url            string
+}
+
+// queueLinkPreview asks the workers to fetch the preview of the first link in the text of the message. It never
+// blocks: if previews are disabled, the text has no link or the queue is full, the message stays without preview.
+func (rt *_router) queueLinkPreview(conversationID string, m database.Message) {
+	if rt.previews == nil || m.MessageContent.Type != "text" {
+		return
+	}
+	url := linkpreview.FindURL(m.MessageContent.Text)
+	if url == "" {
+		return
+	}
+	select {
+	case rt.previewQueue <- linkPreviewJob{conversationID: conversationID, messageID: m.ID, url: url}:
+	default:
+		rt.baseLogger.Warn("link preview: queue full, preview skipped")
+	}
+}
+
+// linkPreviewWorker fetches the previews of the queued messages and saves them, until rt.stop is closed
+func (rt *_router) linkPreviewWorker() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rt.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-rt.stop:
+			return
+		case job := <-rt.previewQueue:
+			p, err := rt.previews.Fetch(ctx, job.url)
+			if err != nil {
+				rt.baseLogger.WithError(err).Debugf("link preview: no preview for %s", job.url)
+				continue
+			}
+			preview := database.MessagePreview{
+				Type:         "link",
+				Content:      p.URL,
+				ThumbnailURL: p.ImageURL,
+				Title:        p.Title,
+				Description:  p.Description,
+			}
+			if err := rt.db.SetMessagePreview(job.conversationID, job.messageID, preview); err != nil {
+				rt.baseLogger.WithError(err).Error("link preview: can't save the preview")
+			}
+		}
+	}
+}
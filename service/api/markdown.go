@@ -0,0 +1,292 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/database"
+)
+
+// Limiti del markdown-lite
+const (
+	maxFormatEntities = 100
+	maxLinkURLLength  = 2048
+	maxMarkdownLength = 10000 // caratteri; il testo semplice non ha limiti
+)
+
+// markdownEscapable sono i caratteri che si possono proteggere con il backslash per scriverli così come sono
+const markdownEscapable = "\\*_~`[]()"
+
+// formatText applica al testo del messaggio il formato `format`: "" o "plain" lasciano il testo com'è, "markdown" lo
+// converte in testo semplice più le entità di formattazione. L'errore ritornato è il messaggio da mostrare al client.
+func formatText(content *database.MessageContent, format string) error {
+	switch format {
+	case "", "plain":
+		return nil
+	case database.FormatMarkdown:
+		text, entities, err := parseMarkdown(content.Text)
+		if err != nil {
+			return err
+		}
+		content.Text, content.Entities, content.Format = text, entities, database.FormatMarkdown
+		return nil
+	}
+	return errors.New("Unsupported text format")
+}
+
+// parseMarkdown converte un testo in markdown-lite nel testo semplice da mostrare e nelle entità che lo formattano:
+//
+//	**grassetto**  *corsivo* o _corsivo_  ~~barrato~~  `codice`  ```blocco di codice```  [testo](https://url)
+//
+// I marcatori senza chiusura restano come testo e con il backslash si scrive un marcatore così com'è. I link con
+// schemi diversi da http e https perdono il link ma non il testo. I caratteri di controllo (tranne a capo e tab) e
+// quelli che invertono la direzione del testo vengono tolti.
+func parseMarkdown(src string) (string, []database.Entity, error) {
+	if !utf8.ValidString(src) {
+		return "", nil, errors.New("Invalid text")
+	}
+	if utf8.RuneCountInString(src) > maxMarkdownLength {
+		return "", nil, errors.New("Text too long for markdown formatting")
+	}
+	p := newMDParser([]rune(src))
+	p.parse(0, len(p.src))
+	if len(p.entities) > maxFormatEntities {
+		return "", nil, errors.New("Too much formatting")
+	}
+	// prima le entità che cominciano prima; a parità, quella che contiene l'altra
+	sort.SliceStable(p.entities, func(i, j int) bool {
+		a, b := p.entities[i], p.entities[j]
+		return a.Offset < b.Offset || (a.Offset == b.Offset && a.Length > b.Length)
+	})
+	return string(p.out), p.entities, nil
+}
+
+// mdParser accumula il testo semplice e le entità, con gli offset calcolati sul testo semplice. Le posizioni sono
+// indici in src; closeAt e urlEnd sono calcolate una volta sola, così cercare la chiusura dei link non riscorre il
+// testo per ogni "[" e il parsing resta lineare. Le parentesi bilanciate fanno parte dell'URL, come in
+// https://it.wikipedia.org/wiki/Roma_(città); uno spazio o un a capo lo interrompono.
+type mdParser struct {
+	src      []rune
+	closeAt  []int // closeAt[i]: posizione della prima "]" non protetta dal backslash da i in poi, o -1
+	urlEnd   []int // urlEnd[i]: posizione della ")" che chiude l'URL di un link cominciato in i, o -1
+	out      []rune
+	entities []database.Entity
+}
+
+func newMDParser(src []rune) *mdParser {
+	p := &mdParser{src: src, closeAt: make([]int, len(src)+1), urlEnd: make([]int, len(src)+1)}
+	escaped := make([]bool, len(src))
+	for i := 0; i+1 < len(src); i++ {
+		if src[i] == '\\' {
+			escaped[i+1] = true
+			i++
+		}
+	}
+	p.closeAt[len(src)], p.urlEnd[len(src)] = -1, -1
+	for i := len(src) - 1; i >= 0; i-- {
+		p.closeAt[i] = p.closeAt[i+1]
+		if src[i] == ']' && !escaped[i] {
+			p.closeAt[i] = i
+		}
+		switch src[i] {
+		case ' ', '\n':
+			p.urlEnd[i] = -1
+		case ')':
+			p.urlEnd[i] = i
+		case '(':
+			// l'URL continua dopo la parentesi che chiude questa
+			p.urlEnd[i] = -1
+			if end := p.urlEnd[i+1]; end >= 0 {
+				p.urlEnd[i] = p.urlEnd[end+1]
+			}
+		default:
+			p.urlEnd[i] = p.urlEnd[i+1]
+		}
+	}
+	return p
+}
+
+// within ritorna pos se cade prima di hi, altrimenti -1
+func within(pos, hi int) int {
+	if pos >= hi {
+		return -1
+	}
+	return pos
+}
+
+// parse converte src[lo:hi]
+func (p *mdParser) parse(lo, hi int) {
+	s := p.src[:hi]
+	for i := lo; i < hi; {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < hi && strings.ContainsRune(markdownEscapable, s[i+1]):
+			p.write(s[i+1])
+			i += 2
+			continue
+
+		case hasRunePrefix(s[i:], "```"):
+			if end := findClosing(s, i+3, "```"); end >= 0 {
+				code := s[i+3 : end]
+				if len(code) > 0 && code[0] == '\n' {
+					code = code[1:]
+				}
+				if len(code) > 0 && code[len(code)-1] == '\n' {
+					code = code[:len(code)-1]
+				}
+				p.raw(database.EntityPre, code)
+				i = end + 3
+				continue
+			}
+
+		case c == '`':
+			if end := findClosing(s, i+1, "`"); end > i+1 {
+				p.raw(database.EntityCode, s[i+1:end])
+				i = end + 1
+				continue
+			}
+
+		case hasRunePrefix(s[i:], "**"), hasRunePrefix(s[i:], "~~"):
+			kind := database.EntityBold
+			if c == '~' {
+				kind = database.EntityStrikethrough
+			}
+			end := findClosing(s, i+2, string(s[i:i+2]))
+			if c == '*' && i+2 < hi && s[i+2] == '*' && end > i+2 && end+2 < hi && s[end+2] == '*' {
+				// ***testo***: il grassetto contiene il corsivo
+				end++
+			}
+			if end > i+2 && trimmed(s[i+2:end]) {
+				p.styled(kind, i+2, end)
+				i = end + 2
+				continue
+			}
+
+		case c == '*':
+			if end := findClosing(s, i+1, "*"); end > i+1 && trimmed(s[i+1:end]) {
+				p.styled(database.EntityItalic, i+1, end)
+				i = end + 1
+				continue
+			}
+
+		case c == '_' && (i == lo || !isWordRune(s[i-1])):
+			// come in markdown, _ dentro le parole (snake_case) non è un marcatore
+			end := findClosing(s, i+1, "_")
+			for end > 0 && end+1 < hi && isWordRune(s[end+1]) {
+				end = findClosing(s, end+1, "_")
+			}
+			if end > i+1 && trimmed(s[i+1:end]) {
+				p.styled(database.EntityItalic, i+1, end)
+				i = end + 1
+				continue
+			}
+
+		case c == '[':
+			if textEnd := within(p.closeAt[i+1], hi); textEnd > i+1 && textEnd+1 < hi && s[textEnd+1] == '(' {
+				if urlEnd := within(p.urlEnd[textEnd+2], hi); urlEnd > textEnd+2 {
+					start := len(p.out)
+					p.parse(i+1, textEnd)
+					if link := safeLinkURL(string(s[textEnd+2 : urlEnd])); link != "" && len(p.out) > start {
+						p.entities = append(p.entities, database.Entity{
+							Type: database.EntityLink, Offset: start, Length: len(p.out) - start, URL: link,
+						})
+					}
+					i = urlEnd + 1
+					continue
+				}
+			}
+		}
+
+		p.write(c)
+		i++
+	}
+}
+
+// styled aggiunge il testo src[lo:hi], che può contenere altra formattazione, con l'entità `kind`
+func (p *mdParser) styled(kind string, lo, hi int) {
+	start := len(p.out)
+	p.parse(lo, hi)
+	if len(p.out) > start {
+		p.entities = append(p.entities, database.Entity{Type: kind, Offset: start, Length: len(p.out) - start})
+	}
+}
+
+// raw aggiunge il codice `code` così com'è, con l'entità `kind`
+func (p *mdParser) raw(kind string, code []rune) {
+	start := len(p.out)
+	for _, c := range code {
+		p.write(c)
+	}
+	if len(p.out) > start {
+		p.entities = append(p.entities, database.Entity{Type: kind, Offset: start, Length: len(p.out) - start})
+	}
+}
+
+// write aggiunge un carattere al testo semplice, togliendo quelli non sicuri
+func (p *mdParser) write(c rune) {
+	if (unicode.IsControl(c) && c != '\n' && c != '\t') || isBidiControl(c) {
+		return
+	}
+	p.out = append(p.out, c)
+}
+
+// findClosing ritorna la posizione del marcatore `delim` che chiude quello aperto prima di `from`, o -1. I caratteri
+// protetti dal backslash non contano e, cercando "*", le coppie "**" (il grassetto dentro il corsivo) vengono saltate.
+func findClosing(s []rune, from int, delim string) int {
+	for i := from; i < len(s); i++ {
+		if s[i] == '\\' && delim != "`" && delim != "```" {
+			i++
+			continue
+		}
+		if delim == "*" && hasRunePrefix(s[i:], "**") {
+			i++
+			continue
+		}
+		if hasRunePrefix(s[i:], delim) {
+			return i
+		}
+	}
+	return -1
+}
+
+// trimmed dice se il testo non comincia e non finisce con uno spazio: "2 * 3 * 4" non è in corsivo
+func trimmed(s []rune) bool {
+	return len(s) > 0 && !unicode.IsSpace(s[0]) && !unicode.IsSpace(s[len(s)-1])
+}
+
+func hasRunePrefix(s []rune, prefix string) bool {
+	i := 0
+	for _, c := range prefix {
+		if i >= len(s) || s[i] != c {
+			return false
+		}
+		i++
+	}
+	return true
+}
+
+func isWordRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// isBidiControl dice se c è un carattere che cambia la direzione del testo, usato per nascondere il vero contenuto
+func isBidiControl(c rune) bool {
+	return (c >= 0x202A && c <= 0x202E) || (c >= 0x2066 && c <= 0x2069)
+}
+
+// safeLinkURL ritorna l'URL normalizzato se è un link http o https assoluto, altrimenti una stringa vuota
+func safeLinkURL(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > maxLinkURLLength {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/flbonanni/WASAText/service/database"
+)
+
+func ent(kind string, offset, length int) database.Entity {
+	return database.Entity{Type: kind, Offset: offset, Length: length}
+}
+
+func link(offset, length int, url string) database.Entity {
+	return database.Entity{Type: database.EntityLink, Offset: offset, Length: length, URL: url}
+}
+
+// A parità di posizione e lunghezza le entità restano nell'ordine in cui sono state chiuse: prima la più interna.
+func TestParseMarkdown(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		src      string
+		text     string
+		entities []database.Entity
+	}{
+		{"plain", "ciao a tutti", "ciao a tutti", nil},
+		{"bold", "un **test**", "un test", []database.Entity{ent(database.EntityBold, 3, 4)}},
+		{"italic", "*a* e _b_", "a e b", []database.Entity{
+			ent(database.EntityItalic, 0, 1), ent(database.EntityItalic, 4, 1),
+		}},
+		{"strikethrough", "~~no~~", "no", []database.Entity{ent(database.EntityStrikethrough, 0, 2)}},
+		{"code", "usa `a*b*c`", "usa a*b*c", []database.Entity{ent(database.EntityCode, 4, 5)}},
+		{"code block", "```\nx := **1**\n```", "x := **1**", []database.Entity{ent(database.EntityPre, 0, 10)}},
+		{"nested", "**a *b* c**", "a b c", []database.Entity{
+			ent(database.EntityBold, 0, 5), ent(database.EntityItalic, 2, 1),
+		}},
+		{"bold italic", "***x***", "x", []database.Entity{
+			ent(database.EntityItalic, 0, 1), ent(database.EntityBold, 0, 1),
+		}},
+		{"bold italic in text", "a ***xy*** b", "a xy b", []database.Entity{
+			ent(database.EntityItalic, 2, 2), ent(database.EntityBold, 2, 2),
+		}},
+
+		// marcatori senza chiusura
+		{"unclosed bold", "**ciao", "**ciao", nil},
+		{"unclosed italic", "*ciao", "*ciao", nil},
+		{"unclosed code", "`ciao", "`ciao", nil},
+		{"unclosed code block", "```ciao", "```ciao", nil},
+		{"unclosed link", "[ciao](https://example.com", "[ciao](https://example.com", nil},
+		{"unclosed link text", "[ciao", "[ciao", nil},
+		{"spaced asterisks", "2 * 3 * 4", "2 * 3 * 4", nil},
+		{"snake_case", "una_variabile_lunga", "una_variabile_lunga", nil},
+		{"empty markers", "**** __", "**** __", nil},
+
+		// escape
+		{"escaped bold", `\*\*no\*\*`, "**no**", nil},
+		{"escaped backslash", `\\*a*`, `\a`, []database.Entity{ent(database.EntityItalic, 1, 1)}},
+		{"escaped closing", `*a\*b*`, "a*b", []database.Entity{ent(database.EntityItalic, 0, 3)}},
+		{"escaped bracket", `[a\]b](https://example.com)`, "a]b", []database.Entity{link(0, 3, "https://example.com")}},
+		{"backslash before letter", `a\b`, `a\b`, nil},
+
+		// link
+		{"link", "vai [qui](https://example.com/a?b=c)", "vai qui", []database.Entity{
+			link(4, 3, "https://example.com/a?b=c"),
+		}},
+		{"link with balanced parens", "[Roma](https://it.wikipedia.org/wiki/Roma_(città)) ok", "Roma ok", []database.Entity{
+			link(0, 4, "https://it.wikipedia.org/wiki/Roma_%28citt%C3%A0%29"),
+		}},
+		{"link followed by parens", "[a](https://example.com) (b)", "a (b)", []database.Entity{
+			link(0, 1, "https://example.com"),
+		}},
+		{"formatted link text", "[**a**](http://example.com)", "a", []database.Entity{
+			ent(database.EntityBold, 0, 1), link(0, 1, "http://example.com"),
+		}},
+		{"javascript link", "[clicca](javascript:alert(1))", "clicca", nil},
+		{"data link", "[x](data:text/html,ciao)", "x", nil},
+		{"relative link", "[x](/percorso)", "x", nil},
+		{"space in url", "[x](https://example.com/a b)", "[x](https://example.com/a b)", nil},
+
+		// caratteri di controllo e bidi
+		{"bidi override", "file\u202egpj.exe", "filegpj.exe", nil},
+		{"bidi isolate", "a\u2066b\u2069c", "abc", nil},
+		{"control characters", "a\x00b\x1bc\x7f", "abc", nil},
+		{"newline and tab kept", "a\n\tb", "a\n\tb", nil},
+		{"bidi inside code", "`a\u202eb`", "ab", []database.Entity{ent(database.EntityCode, 0, 2)}},
+	} {
+		text, entities, err := parseMarkdown(c.src)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if text != c.text || !reflect.DeepEqual(entities, c.entities) {
+			t.Errorf("%s: parseMarkdown(%q) = %q, %v, want %q, %v", c.name, c.src, text, entities, c.text, c.entities)
+		}
+	}
+}
+
+func TestParseMarkdownErrors(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		src  string
+	}{
+		{"invalid utf-8", "a\xffb"},
+		{"too long", strings.Repeat("a", maxMarkdownLength+1)},
+		{"too much formatting", strings.Repeat("*a* ", maxFormatEntities+1)},
+	} {
+		if _, _, err := parseMarkdown(c.src); err == nil {
+			t.Errorf("%s: parseMarkdown succeeded", c.name)
+		}
+	}
+}
+
+func TestParseMarkdownLinear(t *testing.T) {
+	// molti "[" senza chiusura e molte "(" senza ")": con una ricerca per ogni marcatore il parsing sarebbe quadratico
+	for _, src := range []string{
+		strings.Repeat("[", maxMarkdownLength),
+		strings.Repeat("[a](", maxMarkdownLength/4),
+		strings.Repeat("[a](http://x/(", maxMarkdownLength/14),
+	} {
+		text, _, err := parseMarkdown(src)
+		if err != nil || text != src {
+			t.Errorf("parseMarkdown(%.20q...) changed the text or failed: %v", src, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxMarkRead è il numero massimo di menzioni che si possono segnare come lette con una richiesta
+const maxMarkRead = 100
+
+// getMentions ritorna i messaggi e le risposte in cui l'utente è stato menzionato, dal più recente. Con `unread=true`
+// ritorna solo le menzioni non ancora lette.
+func (rt *_router) getMentions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	dbUser, ok := rt.loadMentionsOwner(w, r, ps)
+	if !ok {
+		return
+	}
+	before, limit, ok := pageParams(w, r, "before", defaultThreadPage, maxThreadPage)
+	if !ok {
+		return
+	}
+	unreadOnly := false
+	if v := r.URL.Query().Get("unread"); v != "" {
+		var err error
+		if unreadOnly, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "Invalid unread", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mentions, err := rt.db.GetMentions(dbUser, before, limit, unreadOnly)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if mentions == nil {
+		mentions = []database.Mention{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(mentions)
+}
+
+// markMentionsRead segna come lette le menzioni nei messaggi indicati nel body o, se non ce ne sono, tutte.
+func (rt *_router) markMentionsRead(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	dbUser, ok := rt.loadMentionsOwner(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		MessageIDs []int `json:"message_ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if len(reqBody.MessageIDs) > maxMarkRead {
+		http.Error(w, "Too many message_ids", http.StatusBadRequest)
+		return
+	}
+
+	if err := rt.db.MarkMentionsRead(dbUser.ID, reqBody.MessageIDs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMentionsOwner autentica l'utente e controlla che la casella delle menzioni richiesta sia la sua. In caso di
+// errore scrive la risposta e ritorna ok = false.
+func (rt *_router) loadMentionsOwner(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.User, bool) {
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return dbUser, false
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return dbUser, false
+	}
+	return dbUser, true
+}
+
+// canMentionAll indica se l'utente può menzionare tutti i membri con @all: possono farlo owner e admin dei gruppi.
+func (rt *_router) canMentionAll(conv database.Conversation, user User) (bool, error) {
+	if !conv.IsGroup {
+		return false, nil
+	}
+	group, err := rt.db.GetGroup(conv.ConversationID)
+	if err != nil {
+		return false, err
+	}
+	return group.Can(user.CurrentUsername, database.RoleAdmin), nil
+}
@@ -5,14 +5,14 @@ import (
     "errors"
     "net/http"
     "strconv"
-    "time"
+    "strings"
 
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
 	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
 	"github.com/julienschmidt/httprouter"
 )
 
-
 func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
     // 1) Autenticazione
     token := getToken(r.Header.Get("Authorization"))
@@ -24,68 +24,104 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
     }
     user.FromDatabase(dbUser)
 
-    // 2) Decodifica del body JSON
+    // 2) Decodifica del body JSON. File e audio arrivano invece in un body multipart, letto solo dopo aver controllato
+    //    che l'utente possa scrivere nella conversazione
+    isUpload := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
     var payload struct {
         Type         string   `json:"type"`
         Content      string   `json:"content"`
-        Participants []string `json:"participants,omitempty"`
+        Format       string   `json:"format,omitempty"` // "plain" (default) o "markdown", solo per i testi
+        Poll         *pollRequest `json:"poll,omitempty"` // solo per i sondaggi; la domanda è in Content
     }
-    if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !isUpload {
+        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    // 3) Recupero della conversazione, che deve già esistere: si crea con createConversation
+    conv, err := rt.db.GetConversation(ps.ByName("conversation_id"))
+    if errors.Is(err, database.ErrConversationDoesNotExist) {
+        http.Error(w, "Conversation does not exist", http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
-    // 3) Recupero o creazione conversazione
-    conversationID := ps.ByName("conversation_id")
-    conv, err := rt.db.GetConversation(conversationID)
-    if err != nil {
-        if errors.Is(err, database.ErrConversationDoesNotExist) {
-            if len(payload.Participants) < 2 {
-                http.Error(w,
-                    "conversation does not exist; provide at least two participants to create it",
-                    http.StatusBadRequest)
-                return
-            }
-            conv, err = rt.db.CreateConversation(conversationID, payload.Participants)
-            if err != nil {
-                http.Error(w, "cannot create conversation: "+err.Error(),
-                    http.StatusInternalServerError)
-                return
-            }
-        } else {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
+    // Solo i partecipanti (per i gruppi, i membri attuali non silenziati) possono scrivere nella conversazione
+    if !rt.checkCanPost(w, conv, user) {
+        return
     }
 
     // 4) Costruzione del messaggio
     var msg database.Message
-    msg.Timestamp = time.Now()
+    msg.Timestamp = globaltime.Now()
     // Converto user.ID (uint64) a string per SenderID
     msg.SenderID = strconv.FormatUint(user.ID, 10)
 
+    if isUpload {
+        msg.MessageContent, err = rt.storeAttachment(r, user.ID)
+        if err != nil {
+            attachmentError(w, err)
+            return
+        }
+        payload.Type = msg.MessageContent.Type
+    }
+
     switch payload.Type {
     case "text":
         msg.MessageContent = database.MessageContent{
             Type: payload.Type,
             Text: payload.Content,
         }
+        if err := formatText(&msg.MessageContent, payload.Format); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
     case "image":
         msg.MessageContent = database.MessageContent{
             Type:     payload.Type,
             ImageURL: payload.Content,
         }
+    case database.MessageTypeFile, database.MessageTypeAudio:
+        if !isUpload {
+            http.Error(w, "file and audio messages must be sent as multipart/form-data", http.StatusBadRequest)
+            return
+        }
+    case database.MessageTypePoll:
+        poll, err := newPoll(payload.Content, payload.Poll)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        msg.MessageContent = database.MessageContent{
+            Type: payload.Type,
+            Poll: poll,
+        }
     default:
         http.Error(w, "unsupported message type", http.StatusBadRequest)
         return
     }
 
     // 5) Salvataggio nel DB
-    msgSaved, err := rt.db.SendMessage(conv.ConversationID, msg)
+    mentionAll, err := rt.canMentionAll(conv, user)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
+    msgSaved, err := rt.db.SendMessage(conv.ConversationID, msg, mentionAll, rt.storageQuota)
+    if errors.Is(err, database.ErrStorageQuotaExceeded) {
+        http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // L'anteprima dei link arriva dopo: il client la vedrà rileggendo il messaggio
+    rt.queueLinkPreview(conv.ConversationID, msgSaved)
 
     // 6) Risposta JSON
     w.Header().Set("Content-Type", "application/json")
@@ -95,55 +131,6 @@ func (rt *_router) sendMessage(w http.ResponseWriter, r *http.Request, ps httpro
     }
 }
 
-func (rt *_router) forwardMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
-	// Verifica autenticazione
-	var user User
-	var requestUser User
-	token := getToken(r.Header.Get("Authorization"))
-    requestUser.ID = token
-    dbUser, err := rt.db.CheckUserById(requestUser.ToDatabase())
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	user.FromDatabase(dbUser)
-
-	// Estrai parametri dalla URL
-	_ = ps.ByName("username")              // username del richiedente (per eventuali controlli)
-	// conversationId := ps.ByName("conversation_id")
-	messageId := ps.ByName("message_id")
-
-	// Decodifica il body in una mappa senza definire una nuova struct
-	var reqBody map[string]string
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Recupera i valori richiesti dalla mappa
-	targetConversationId, ok := reqBody["target_conversation_id"]
-	if !ok || targetConversationId == "" {
-		http.Error(w, "target_conversation_id mancante", http.StatusBadRequest)
-		return
-	}
-	// recipient_username è opzionale se non fornito
-	recipientUsername := reqBody["recipient_username"]
-
-	// Esegui il forward del messaggio tramite il layer DB (funzione ipotetica)
-	forwardedMsg, err := rt.db.ForwardMessage(messageId, targetConversationId, recipientUsername, user.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Rispondi con il messaggio inoltrato (HTTP 200)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(forwardedMsg)
-}
-
-
 func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
     // 1) Autenticazione
     token := getToken(r.Header.Get("Authorization"))
@@ -162,16 +149,67 @@ func (rt *_router) deleteMessage(w http.ResponseWriter, r *http.Request, ps http
     conversationID := ps.ByName("conversation_id")
     messageID := ps.ByName("message_id")
 
-    // 3) Chiamata al DB
-    if err := rt.db.DeleteMessage(conversationID, messageID, token); err != nil {
+    rt.deleteMessageAs(w, conversationID, messageID, user)
+}
+
+// deleteMessageAs cancella il messaggio per conto dell'utente e scrive la risposta. Le regole sono le stesse per i
+// messaggi della conversazione e per le risposte nei thread.
+func (rt *_router) deleteMessageAs(w http.ResponseWriter, conversationID string, messageID string, user User) {
+    // Nei gruppi chi ha il permesso DeleteMessages può cancellare anche i messaggi degli altri
+    anySender := false
+    group, err := rt.db.GetGroup(conversationID)
+    if err == nil {
+        anySender = group.Can(user.CurrentUsername, group.Permissions.DeleteMessages)
+    } else if !errors.Is(err, database.ErrGroupNotFound) {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    // Chiamata al DB
+    if err := rt.db.DeleteMessage(conversationID, messageID, user.ID, anySender); err != nil {
         if err == database.ErrMessageDoesNotExist {
             http.Error(w, "Message not found", http.StatusNotFound)
+        } else if err == database.ErrSystemMessage {
+            http.Error(w, "System messages cannot be deleted", http.StatusForbidden)
         } else {
             http.Error(w, err.Error(), http.StatusInternalServerError)
         }
         return
     }
 
-    // 4) Risposta
+    // Risposta
     w.WriteHeader(http.StatusNoContent) // 204
 }
+
+// Dimensione delle pagine di getMessages
+const (
+	defaultMessagesPage = 50
+	maxMessagesPage     = 100
+)
+
+// getMessages ritorna i messaggi della conversazione dal più recente, con le reaction raggruppate per emoji. Per le
+// pagine successive si passa in `before` l'ID dell'ultimo messaggio ricevuto.
+func (rt *_router) getMessages(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	before, limit, ok := pageParams(w, r, "before", defaultMessagesPage, maxMessagesPage)
+	if !ok {
+		return
+	}
+
+	messages, err := rt.db.GetMessages(conv.ConversationID, user.ID, before, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []database.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// pinMessage fissa un messaggio nella conversazione. Nei gruppi possono farlo solo owner e admin.
+func (rt *_router) pinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationForPins(w, r, ps)
+	if !ok {
+		return
+	}
+
+	err := rt.db.PinMessage(conv.ConversationID, ps.ByName("message_id"), user.ToDatabase(), rt.maxPins)
+	switch {
+	case errors.Is(err, database.ErrMessageDoesNotExist):
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	case errors.Is(err, database.ErrNotTopLevel):
+		http.Error(w, "Thread replies cannot be pinned", http.StatusBadRequest)
+		return
+	case errors.Is(err, database.ErrSystemMessage):
+		http.Error(w, "System messages cannot be pinned", http.StatusForbidden)
+		return
+	case errors.Is(err, database.ErrMessageAlreadyPinned):
+		http.Error(w, "Message already pinned", http.StatusConflict)
+		return
+	case errors.Is(err, database.ErrTooManyPins):
+		http.Error(w, "Too many pinned messages", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unpinMessage toglie un messaggio da quelli fissati, con gli stessi permessi di pinMessage.
+func (rt *_router) unpinMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationForPins(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := rt.db.UnpinMessage(conv.ConversationID, ps.ByName("message_id"), user.ToDatabase()); errors.Is(err, database.ErrPinDoesNotExist) {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getPins elenca i messaggi fissati nella conversazione, dal più recente.
+func (rt *_router) getPins(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	pins, err := rt.db.GetPins(conv.ConversationID, user.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pins == nil {
+		pins = []database.Pin{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(pins)
+}
+
+// loadConversationForPins carica la conversazione e verifica che l'utente possa fissare messaggi: basta essere
+// partecipanti, ma nei gruppi serve il ruolo di admin. In caso di errore la risposta è già stata scritta.
+func (rt *_router) loadConversationForPins(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (database.Conversation, User, bool) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok || !conv.IsGroup {
+		return conv, user, ok
+	}
+
+	group, err := rt.db.GetGroup(conv.ConversationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return conv, user, false
+	}
+	if !group.Can(user.CurrentUsername, database.RoleAdmin) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return conv, user, false
+	}
+	return conv, user, true
+}
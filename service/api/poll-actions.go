@@ -0,0 +1,127 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Limiti dei sondaggi
+const (
+	minPollOptions          = 2
+	maxPollOptions          = 10
+	maxPollQuestionLength   = 300
+	maxPollOptionTextLength = 100
+)
+
+// pollRequest contiene le impostazioni di un sondaggio nel body di sendMessage
+type pollRequest struct {
+	Options        []string   `json:"options"`
+	MultipleChoice bool       `json:"multiple_choice"`
+	Anonymous      bool       `json:"anonymous"`
+	ClosesAt       *time.Time `json:"closes_at,omitempty"`
+}
+
+// newPoll valida la domanda e le impostazioni di un nuovo sondaggio. L'errore ritornato è il messaggio da mostrare al
+// client.
+func newPoll(question string, req *pollRequest) (*database.Poll, error) {
+	question = strings.TrimSpace(question)
+	if question == "" || utf8.RuneCountInString(question) > maxPollQuestionLength {
+		return nil, errors.New("Invalid poll question")
+	}
+	if req == nil || len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return nil, errors.New("A poll must have between 2 and 10 options")
+	}
+	if req.ClosesAt != nil && !req.ClosesAt.After(globaltime.Now()) {
+		return nil, errors.New("The poll close time must be in the future")
+	}
+
+	poll := database.Poll{
+		Question:       question,
+		MultipleChoice: req.MultipleChoice,
+		Anonymous:      req.Anonymous,
+		ClosesAt:       req.ClosesAt,
+	}
+	for i, text := range req.Options {
+		text = strings.TrimSpace(text)
+		if text == "" || utf8.RuneCountInString(text) > maxPollOptionTextLength {
+			return nil, errors.New("Invalid poll option")
+		}
+		for _, o := range poll.Options {
+			if o.Text == text {
+				return nil, errors.New("Poll options must be different")
+			}
+		}
+		poll.Options = append(poll.Options, database.PollOption{ID: i + 1, Text: text})
+	}
+	return &poll, nil
+}
+
+// votePoll registra il voto dell'utente a un sondaggio, sostituendo quello precedente, e ritorna i voti aggiornati.
+func (rt *_router) votePoll(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	var reqBody struct {
+		Options []int `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	poll, err := rt.db.VotePoll(conv.ConversationID, ps.ByName("message_id"), user.ID, reqBody.Options)
+	if !writePollError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(poll)
+}
+
+// retractPollVote toglie il voto dell'utente a un sondaggio ancora aperto e ritorna i voti aggiornati.
+func (rt *_router) retractPollVote(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	poll, err := rt.db.RetractPollVote(conv.ConversationID, ps.ByName("message_id"), user.ID)
+	if !writePollError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(poll)
+}
+
+// writePollError scrive la risposta adatta all'errore di VotePoll o RetractPollVote. Ritorna true se non c'è errore.
+func writePollError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, database.ErrMessageDoesNotExist):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, database.ErrNotAPoll):
+		http.Error(w, "The message is not a poll", http.StatusBadRequest)
+	case errors.Is(err, database.ErrInvalidPollVote):
+		http.Error(w, "Invalid poll options", http.StatusBadRequest)
+	case errors.Is(err, database.ErrPollClosed):
+		http.Error(w, "The poll is closed", http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
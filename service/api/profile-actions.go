@@ -2,9 +2,8 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
-	"bytes"
-    "io"
     "time"
 
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
@@ -17,17 +16,18 @@ func (rt *_router) getUserPicture(w http.ResponseWriter, r *http.Request, ps htt
 	// Extract the username from the URL
 	username := ps.ByName("username")
 
-	// Get the user's profile picture from the database
+	// Get the reference to the user's profile picture from the database
 	picture, err := rt.db.GetUserPicture(username)
-	if err != nil {
+	if errors.Is(err, database.ErrUserDoesNotExist) || errors.Is(err, database.ErrPhotoDoesNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with the image
-	w.Header().Set("Content-Type", "image/jpeg")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(picture)
+	// Respond with the image from the blob store
+	rt.serveBlob(w, r, picture)
 }
 
 func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
@@ -41,35 +41,27 @@ func (rt *_router) setMyPhoto(w http.ResponseWriter, r *http.Request, ps httprou
         return
     }
 
-    // 3. Estrai la foto dal multipart form
-    file, _, err := r.FormFile("photo")
+    // 3. Salva la foto del multipart form nel blob store, senza caricarla in memoria
+    uploaded, err := rt.storeUpload(r, "photo", maxPhotoSize, "image/")
     if err != nil {
-        http.Error(w, "Invalid photo upload: "+err.Error(), http.StatusBadRequest)
-        return
-    }
-    defer file.Close()
-
-    // 4. Copia il contenuto in un buffer
-    buf := &bytes.Buffer{}
-    if _, err := io.Copy(buf, file); err != nil {
-        http.Error(w, "Failed to read photo: "+err.Error(), http.StatusInternalServerError)
+        uploadError(w, err)
         return
     }
 
-    // 5. Costruisci l’oggetto Photo
+    // 4. Costruisci l’oggetto Photo
     photo := database.Photo{
         UserId: dbUser.ID,
-        File:   buf.Bytes(),
+        BlobID: uploaded.BlobID,
         Date:   time.Now().Format(time.RFC3339),
     }
 
-    // 6. Salva la foto nel database
+    // 5. Salva il riferimento alla foto nel database
     if err := rt.db.ChangeUserPhoto(dbUser, photo); err != nil {
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
-    // 7. Rispondi con il JSON del record photo
+    // 6. Rispondi con il JSON del record photo
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusCreated)
     _ = json.NewEncoder(w).Encode(photo)
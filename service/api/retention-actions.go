@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxRetentionDays è la retention massima impostabile per una conversazione (10 anni)
+const maxRetentionDays = 3650
+
+// decodeRetention legge il body {"days": N} di una richiesta di retention. days null riporta alla retention di default.
+func decodeRetention(r *http.Request) (*int, bool) {
+	var reqBody struct {
+		Days *int `json:"days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		return nil, false
+	}
+	if reqBody.Days != nil && (*reqBody.Days < 0 || *reqBody.Days > maxRetentionDays) {
+		return nil, false
+	}
+	return reqBody.Days, true
+}
+
+// setConversationRetention imposta dopo quanti giorni i messaggi della conversazione vengono cancellati.
+// Può farlo qualsiasi partecipante; per la conversazione di un gruppo, come per setGroupRetention, solo owner e admin.
+func (rt *_router) setConversationRetention(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) L'utente deve partecipare alla conversazione
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	// 2) La conversazione di un gruppo ha lo stesso ID del gruppo: la sua policy è quella del gruppo
+	if conv.IsGroup {
+		group, err := rt.db.GetGroup(conv.ConversationID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !group.Can(user.CurrentUsername, database.RoleAdmin) {
+			http.Error(w, "Only group owners and admins can change the retention of a group", http.StatusForbidden)
+			return
+		}
+	}
+
+	// 3) Salvataggio
+	days, ok := decodeRetention(r)
+	if !ok {
+		http.Error(w, "Invalid retention", http.StatusBadRequest)
+		return
+	}
+	if err := rt.db.SetRetentionPolicy(conv.ConversationID, days); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setGroupRetention imposta dopo quanti giorni i messaggi del gruppo vengono cancellati. Possono farlo owner e admin.
+func (rt *_router) setGroupRetention(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+
+	// 2) Solo owner e admin del gruppo
+	group, err := rt.db.GetGroup(ps.ByName("group_id"))
+	if errors.Is(err, database.ErrGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !group.Can(user.CurrentUsername, database.RoleAdmin) {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 3) Salvataggio: la policy del gruppo vale per la sua conversazione, che ha lo stesso ID
+	days, ok := decodeRetention(r)
+	if !ok {
+		http.Error(w, "Invalid retention", http.StatusBadRequest)
+		return
+	}
+	if err := rt.db.SetRetentionPolicy(group.GroupID, days); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getRetentionReport mostra, senza cancellare nulla, quali messaggi il purger cancellerebbe adesso. Solo per gli
+// amministratori del server.
+func (rt *_router) getRetentionReport(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+	if !rt.admins[user.CurrentUsername] {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 2) Report
+	now := globaltime.Now()
+	conversations, err := rt.db.GetRetentionReport(rt.retentionDays, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total := 0
+	for _, c := range conversations {
+		total += c.ExpiredMessages
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"generated_at":           now,
+		"default_days":           rt.retentionDays,
+		"total_expired_messages": total,
+		"conversations":          conversations,
+	})
+}
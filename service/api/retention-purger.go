@@ -0,0 +1,50 @@
+package api
+
+import (
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// retentionPurger deletes the expired messages every `interval`, in batches of `batch` messages, until rt.stop is
+// closed.
+func (rt *_router) retentionPurger(interval time.Duration, batch int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+			rt.purgeExpiredMessages(batch)
+		}
+	}
+}
+
+// purgeExpiredMessages deletes all the messages expired now, one transaction per batch, so that the database is
+// never locked for long
+func (rt *_router) purgeExpiredMessages(batch int) {
+	now := globaltime.Now()
+	total := 0
+	for {
+		select {
+		case <-rt.stop:
+			return
+		default:
+		}
+
+		deleted, err := rt.db.PurgeExpiredMessages(rt.retentionDays, now, batch)
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("retention: can't delete expired messages")
+			return
+		}
+		total += deleted
+		if deleted < batch {
+			break
+		}
+	}
+	if total > 0 {
+		rt.baseLogger.Infof("retention: %d expired messages deleted", total)
+	}
+}
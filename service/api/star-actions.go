@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Dimensione delle pagine di getStarred
+const (
+	defaultStarredPage = 50
+	maxStarredPage     = 100
+)
+
+// starredPage è una pagina dei messaggi preferiti. NextCursor manca nell'ultima pagina.
+type starredPage struct {
+	Starred    []database.Starred `json:"starred"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
+
+// starMessage aggiunge un messaggio ai preferiti dell'utente.
+func (rt *_router) starMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := rt.db.StarMessage(conv.ConversationID, ps.ByName("message_id"), user.ID); errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unstarMessage toglie un messaggio dai preferiti dell'utente.
+func (rt *_router) unstarMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	if err := rt.db.UnstarMessage(conv.ConversationID, ps.ByName("message_id"), user.ID); errors.Is(err, database.ErrStarDoesNotExist) {
+		http.Error(w, "Message is not starred", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getStarred ritorna i messaggi preferiti dell'utente, dall'ultimo aggiunto, eventualmente solo quelli di una
+// conversazione. Per la pagina successiva si passa in `cursor` il next_cursor ricevuto.
+func (rt *_router) getStarred(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 2) Parametri
+	query := r.URL.Query()
+	var cursor int64
+	if v := query.Get("cursor"); v != "" {
+		cursor, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor <= 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, ok := pageLimit(w, r, defaultStarredPage, maxStarredPage)
+	if !ok {
+		return
+	}
+
+	// 3) Lettura: i messaggi delle conversazioni lasciate non compaiono
+	starred, next, err := rt.db.GetStarred(dbUser, query.Get("conversation_id"), cursor, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := starredPage{Starred: starred}
+	if page.Starred == nil {
+		page.Starred = []database.Starred{}
+	}
+	if next > 0 {
+		page.NextCursor = strconv.FormatInt(next, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(page)
+}
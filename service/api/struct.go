@@ -20,6 +20,15 @@ type Conversation struct {
 	ConversationID string   `json:"conversation_id"`
 	Participants   []string `json:"participants"`
 	LastMessage    string   `json:"last_message,omitempty"` // omitempty allows the field to be optional
+	LastSender     string   `json:"last_sender,omitempty"`
+	LastActivity   *time.Time `json:"last_activity,omitempty"`
+	IsGroup        bool     `json:"is_group"`
+	GroupName      string   `json:"group_name,omitempty"`
+	GroupPhoto     string   `json:"group_photo,omitempty"`
+	DisappearingTimer string `json:"disappearing_timer"`
+	UnreadCount    int      `json:"unread_count,omitempty"`
+	HasMention     bool     `json:"has_mention,omitempty"`
+	HasDraft       bool     `json:"has_draft,omitempty"`
 }
 
 // Message represents a single message in a conversation.
@@ -35,9 +44,11 @@ type Message struct {
 
 // MessagePreview represents the preview of a message.
 type MessagePreview struct {
-	Type         string `json:"type"` // "text" or "image"
-	Content      string `json:"content"`
-	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Type         string `json:"type"` // "text", "image" or "link"
+	Content      string `json:"content"`                 // for "link", the URL of the page
+	ThumbnailURL string `json:"thumbnail_url,omitempty"` // for "link", the image of the page
+	Title        string `json:"title,omitempty"`         // only for "link"
+	Description  string `json:"description,omitempty"`   // only for "link"
 }
 
 // Comment represents an emoji reaction to a message.
@@ -56,15 +67,41 @@ type MessageStatus struct {
 
 // MessageContent represents the content of a message.
 type MessageContent struct {
-	Type     string `json:"type"` // "text" or "image"
-	Text     string `json:"text,omitempty"`
-	ImageURL string `json:"image_url,omitempty"`
+	Type     string                `json:"type"` // "text", "image", "poll" or "system"
+	Text     string                `json:"text,omitempty"`
+	Format   string                `json:"format,omitempty"`
+	ImageURL string                `json:"image_url,omitempty"`
+	Poll     *database.Poll        `json:"poll,omitempty"`
+	Entities []database.Entity     `json:"entities,omitempty"`
+	System   *database.SystemEvent `json:"system,omitempty"`
+}
+
+// Group represents a group chat as seen by its members.
+type Group struct {
+	GroupID          string           `json:"group_id"`
+	Name             string           `json:"group_name"`
+	Description      string           `json:"description"`
+	Members          []string         `json:"members"`
+	Owners           []string         `json:"owners"`
+	Admins           []string         `json:"admins"`
+	Permissions      GroupPermissions `json:"permissions"`
+	PhotoID          string           `json:"photo_id,omitempty"`
+	AnnouncementOnly bool             `json:"announcement_only"`
+}
+
+// GroupPermissions is the minimum role ("owner", "admin" or "member") needed for each action in a group.
+type GroupPermissions struct {
+	Rename         string `json:"rename"`
+	ChangePhoto    string `json:"change_photo"`
+	AddMembers     string `json:"add_members"`
+	RemoveMembers  string `json:"remove_members"`
+	DeleteMessages string `json:"delete_messages"`
 }
 
 type Photo struct {
 	Id            uint64 `json:"id"`
 	UserId        uint64 `json:"userId"`
-	File          []byte `json:"file"`
+	BlobID        string `json:"blob_id"`
 	Date          string `json:"date"`
 }
 
@@ -84,4 +121,43 @@ func (c *Conversation) ConvFromDatabase(conv Conversation) {
 	c.ConversationID = conv.ConversationID
 	c.Participants = conv.Participants
 	c.LastMessage = conv.LastMessage
+	c.LastSender = conv.LastSender
+	c.LastActivity = conv.LastActivity
+	c.IsGroup = conv.IsGroup
+	c.GroupName = conv.GroupName
+	c.GroupPhoto = conv.GroupPhoto
+	c.DisappearingTimer = conv.DisappearingTimer
+	c.UnreadCount = conv.UnreadCount
+	c.HasMention = conv.HasMention
+	c.HasDraft = conv.HasDraft
+}
+
+func (g *Group) FromDatabase(group database.Group) {
+	g.GroupID = group.GroupID
+	g.Name = group.Name
+	g.Description = group.Description
+	g.Members = group.Members
+	g.Owners = group.Owners
+	g.Admins = group.Admins
+	g.Permissions.FromDatabase(group.Permissions)
+	g.PhotoID = group.PhotoID
+	g.AnnouncementOnly = group.AnnouncementOnly
+}
+
+func (p *GroupPermissions) FromDatabase(perm database.GroupPermissions) {
+	p.Rename = perm.Rename
+	p.ChangePhoto = perm.ChangePhoto
+	p.AddMembers = perm.AddMembers
+	p.RemoveMembers = perm.RemoveMembers
+	p.DeleteMessages = perm.DeleteMessages
+}
+
+func (p *GroupPermissions) ToDatabase() database.GroupPermissions {
+	return database.GroupPermissions{
+		Rename:         p.Rename,
+		ChangePhoto:    p.ChangePhoto,
+		AddMembers:     p.AddMembers,
+		RemoveMembers:  p.RemoveMembers,
+		DeleteMessages: p.DeleteMessages,
+	}
 }
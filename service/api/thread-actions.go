@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/api/reqcontext"
+	"github.com/flbonanni/WASAText/service/database"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxReplyLength è la lunghezza massima (in caratteri) di una risposta in un thread
+const maxReplyLength = 500
+
+// Dimensione delle pagine di getThread e getMentions
+const (
+	defaultThreadPage = 50
+	maxThreadPage     = 100
+)
+
+// replyToMessage aggiunge una risposta di testo al thread di un messaggio. Può rispondere chi può scrivere nella
+// conversazione; i partecipanti menzionati con @username (o con @all, se a scrivere è un admin del gruppo) ricevono
+// una menzione.
+func (rt *_router) replyToMessage(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+	if !rt.checkCanPost(w, conv, user) {
+		return
+	}
+
+	var reqBody struct {
+		Text   string `json:"text"`
+		Format string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(reqBody.Text) > maxReplyLength {
+		http.Error(w, "Invalid reply text", http.StatusBadRequest)
+		return
+	}
+	content := database.MessageContent{Type: "text", Text: reqBody.Text}
+	if err := formatText(&content, reqBody.Format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(content.Text) == "" {
+		http.Error(w, "Invalid reply text", http.StatusBadRequest)
+		return
+	}
+
+	reply := database.Message{
+		Timestamp:      globaltime.Now(),
+		SenderID:       strconv.FormatUint(user.ID, 10),
+		MessageContent: content,
+	}
+	mentionAll, err := rt.canMentionAll(conv, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reply, err = rt.db.ReplyToMessage(conv.ConversationID, ps.ByName("message_id"), reply, mentionAll)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if errors.Is(err, database.ErrReplyToReply) {
+		http.Error(w, "Cannot reply to a thread reply", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rt.queueLinkPreview(conv.ConversationID, reply)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(reply)
+}
+
+// getThread ritorna le risposte del thread di un messaggio, dalla più vecchia. Per le pagine successive si passa in
+// `after` l'ID dell'ultima risposta ricevuta.
+func (rt *_router) getThread(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+	after, limit, ok := pageParams(w, r, "after", defaultThreadPage, maxThreadPage)
+	if !ok {
+		return
+	}
+
+	replies, err := rt.db.GetThread(conv.ConversationID, ps.ByName("message_id"), user.ID, after, limit)
+	if errors.Is(err, database.ErrMessageDoesNotExist) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if replies == nil {
+		replies = []database.Message{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(replies)
+}
+
+// deleteThreadReply cancella una risposta del thread, con le stesse regole dei messaggi della conversazione.
+func (rt *_router) deleteThreadReply(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	conv, user, ok := rt.loadConversationAsParticipant(w, r, ps)
+	if !ok {
+		return
+	}
+
+	reply, err := rt.db.GetMessage(conv.ConversationID, ps.ByName("reply_id"))
+	if errors.Is(err, database.ErrMessageDoesNotExist) || (err == nil && strconv.Itoa(reply.ParentID) != ps.ByName("message_id")) {
+		http.Error(w, "Reply not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rt.deleteMessageAs(w, conv.ConversationID, ps.ByName("reply_id"), user)
+}
+
+// pageParams legge i parametri di paginazione: il cursore `cursorName` (un ID di messaggio, 0 se manca) e `limit`. Se
+// non sono validi scrive il 400 e ritorna ok = false.
+func pageParams(w http.ResponseWriter, r *http.Request, cursorName string, defaultLimit int, maxLimit int) (cursor int, limit int, ok bool) {
+	if v := r.URL.Query().Get(cursorName); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid "+cursorName, http.StatusBadRequest)
+			return 0, 0, false
+		}
+		cursor = n
+	}
+	limit, ok = pageLimit(w, r, defaultLimit, maxLimit)
+	return cursor, limit, ok
+}
+
+// pageLimit legge il parametro `limit`, che deve essere tra 1 e maxLimit. Se non è valido scrive il 400 e ritorna
+// ok = false.
+func pageLimit(w http.ResponseWriter, r *http.Request, defaultLimit int, maxLimit int) (limit int, ok bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 || n > maxLimit {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/flbonanni/WASAText/service/blobstore"
+)
+
+// maxPhotoSize is the maximum size of profile and group pictures
+const maxPhotoSize = 10 << 20
+
+var errUploadMissing = errors.New("missing file in the upload")
+var errUploadType = errors.New("unsupported file type")
+var errBodyTooLarge = errors.New("request body too large")
+
+// maxMultipartOverhead is the room left by limitBody for the multipart boundaries, the part headers and the form
+// fields next to the file
+const maxMultipartOverhead = 1 << 20
+
+// limitBody makes the reads of the request body fail with errBodyTooLarge after n bytes. The file size limit of the
+// blob store only applies to the file, not to the other parts of a multipart body.
+func limitBody(r *http.Request, n int64) {
+	r.Body = &maxBodyReader{ReadCloser: r.Body, remaining: n}
+}
+
+type maxBodyReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *maxBodyReader) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// one byte more than allowed tells a body of exactly n bytes from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n, b.remaining = int(b.remaining), -1
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// upload describes a file received in a multipart request and saved in the blob store
+type upload struct {
+	BlobID      string
+	ContentType string
+	Filename    string
+	Size        int64
+}
+
+// storeUpload streams the multipart field `field` of the request into the blob store, without buffering the whole
+// file in memory. The content type is sniffed from the first bytes of the file: if allowedPrefix is not empty, it must
+// start with allowedPrefix (e.g., "image/").
+func (rt *_router) storeUpload(r *http.Request, field string, maxSize int64, allowedPrefix string) (upload, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return upload{}, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return upload{}, errUploadMissing
+		} else if err != nil {
+			return upload{}, err
+		}
+		if part.FormName() != field || part.FileName() == "" {
+			_ = part.Close()
+			continue
+		}
+
+		return rt.storePart(part, maxSize, func(contentType string) bool {
+			return allowedPrefix == "" || strings.HasPrefix(contentType, allowedPrefix)
+		})
+	}
+}
+
+// storePart streams a file of a multipart request into the blob store. The content type is sniffed from the first
+// bytes of the file and the file is refused with errUploadType if allowed returns false.
+func (rt *_router) storePart(part *multipart.Part, maxSize int64, allowed func(contentType string) bool) (upload, error) {
+	br := bufio.NewReaderSize(part, 512)
+	head, err := br.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return upload{}, err
+	}
+	contentType := http.DetectContentType(head)
+	if !allowed(contentType) {
+		return upload{}, errUploadType
+	}
+
+	id, size, err := rt.blobs.Put(br, maxSize)
+	if err != nil {
+		return upload{}, err
+	}
+	return upload{BlobID: id, ContentType: contentType, Filename: part.FileName(), Size: size}, nil
+}
+
+// uploadError writes the HTTP error for an error returned by storeUpload
+func uploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, blobstore.ErrBlobTooLarge):
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUploadType):
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+	case errors.Is(err, errUploadMissing), errors.Is(err, http.ErrNotMultipart):
+		http.Error(w, "Invalid file upload", http.StatusBadRequest)
+	default:
+		http.Error(w, "Invalid file upload: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+// serveBlob writes the blob `id` in the response. Blobs never change, so the ID is also a strong ETag. Range requests
+// are supported.
+func (rt *_router) serveBlob(w http.ResponseWriter, r *http.Request, id string) {
+	info, err := rt.blobs.Stat(id)
+	if errors.Is(err, blobstore.ErrBlobDoesNotExist) || errors.Is(err, blobstore.ErrInvalidBlobID) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := rt.blobs.Open(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", `"`+id+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	http.ServeContent(w, r, "", info.ModTime, f)
+}
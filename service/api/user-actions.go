@@ -2,7 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+	"github.com/flbonanni/WASAText/service/database"
 	"github.com/flbonanni/WASAText/service/api/reqcontext"
 	"github.com/julienschmidt/httprouter"
 )
@@ -124,6 +127,12 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
+	// la virgola separa gli username nei membri dei gruppi e nei partecipanti delle conversazioni
+	if user.CurrentUsername == "" || strings.Contains(user.CurrentUsername, ",") {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+
 	// estrarre un token dall'header
 	token := getToken(r.Header.Get("Authorization"))
 	user.ID = token
@@ -140,4 +149,39 @@ func (rt *_router) setMyUserName(w http.ResponseWriter, r *http.Request, ps http
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_ = json.NewEncoder(w).Encode(user)
-}
\ No newline at end of file
+}
+
+// deleteUser cancella l'account dell'utente autenticato. I suoi messaggi vengono cancellati o anonimizzati secondo
+// la policy del server.
+func (rt *_router) deleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+	// 1) Autenticazione
+	token := getToken(r.Header.Get("Authorization"))
+	user := User{ID: token}
+	dbUser, err := rt.db.CheckUserById(user.ToDatabase())
+	if err != nil {
+		http.Error(w, "User does not exist", http.StatusUnauthorized)
+		return
+	}
+	user.FromDatabase(dbUser)
+
+	// 2) Un utente può cancellare solo il proprio account
+	if ps.ByName("username") != user.CurrentUsername {
+		http.Error(w, "Unauthorized action", http.StatusForbidden)
+		return
+	}
+
+	// 3) Cancellazione
+	if err := rt.db.DeleteUser(user.ID, rt.anonymizeDeletedUsers); err != nil {
+		if errors.Is(err, database.ErrUserDoesNotExist) {
+			http.Error(w, "User does not exist", http.StatusNotFound)
+			return
+		}
+		ctx.Logger.WithError(err).Error("can't delete user")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Logger.WithField("user", user.ID).Info("user deleted")
+
+	// 4) Risposta 204 No Content
+	w.WriteHeader(http.StatusNoContent)
+}
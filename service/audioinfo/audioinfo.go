@@ -0,0 +1,173 @@
+/*
+Package audioinfo reads the duration of audio files from their headers, without decoding the audio. Supported formats
+are WAV (RIFF) and Ogg Opus, the format used by browsers and phones to record voice notes.
+
+Example:
+
+	f, err := os.Open("note.ogg")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d, err := audioinfo.Duration(f)
+*/
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+var ErrInvalidFile = errors.New("invalid audio file")
+
+// Duration returns the duration of the WAV or Ogg Opus file r. It returns ErrUnsupportedFormat for other formats and
+// ErrInvalidFile if the headers are damaged.
+func Duration(r io.ReadSeeker) (time.Duration, error) {
+	var magic [4]byte
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return 0, ErrUnsupportedFormat
+	}
+	switch string(magic[:]) {
+	case "RIFF":
+		return wavDuration(r)
+	case "OggS":
+		return opusDuration(r)
+	}
+	return 0, ErrUnsupportedFormat
+}
+
+// maxDuration is longer than any real recording: longer durations come from damaged or crafted headers
+const maxDuration = 1000 * time.Hour
+
+// maxWavChunks limits the chunks skipped looking for the audio data
+const maxWavChunks = 64
+
+// wavDuration reads the "fmt " and "data" chunks of a RIFF WAVE file. r is positioned after "RIFF".
+func wavDuration(r io.ReadSeeker) (time.Duration, error) {
+	var header [8]byte // size of the RIFF chunk, "WAVE"
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[4:]) != "WAVE" {
+		return 0, ErrUnsupportedFormat
+	}
+
+	var byteRate uint32
+	for i := 0; i < maxWavChunks; i++ {
+		var chunk [8]byte // ID, size
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, ErrInvalidFile
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+
+		switch string(chunk[:4]) {
+		case "fmt ":
+			var format [16]byte
+			if size < int64(len(format)) {
+				return 0, ErrInvalidFile
+			}
+			if _, err := io.ReadFull(r, format[:]); err != nil {
+				return 0, ErrInvalidFile
+			}
+			byteRate = binary.LittleEndian.Uint32(format[8:])
+			size -= int64(len(format))
+
+		case "data":
+			if byteRate == 0 {
+				return 0, ErrInvalidFile
+			}
+			// recorders that don't know the final size write 0 or 0xFFFFFFFF: the data go on until the end
+			if size == 0 || size == 0xFFFFFFFF {
+				pos, err := r.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return 0, err
+				}
+				end, err := r.Seek(0, io.SeekEnd)
+				if err != nil {
+					return 0, err
+				}
+				size = end - pos
+			}
+			seconds := float64(size) / float64(byteRate)
+			if seconds > maxDuration.Seconds() {
+				return 0, ErrInvalidFile
+			}
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+
+		// chunks are padded to an even size
+		if _, err := r.Seek(size+size%2, io.SeekCurrent); err != nil {
+			return 0, ErrInvalidFile
+		}
+	}
+	return 0, ErrInvalidFile
+}
+
+// Ogg page header: "OggS", version, header type, granule position (8 bytes), serial number (4), sequence number (4),
+// checksum (4), number of segments
+const oggHeaderSize = 27
+
+// maxOggPageSize is the largest possible Ogg page, header included
+const maxOggPageSize = oggHeaderSize + 255 + 255*255
+
+// opusSampleRate is the rate of the granule positions of Opus streams, whatever the rate of the original audio
+const opusSampleRate = 48000
+
+// opusDuration reads the pre-skip from the OpusHead packet in the first page and the granule position of the last
+// page of the stream. r is positioned after "OggS".
+func opusDuration(r io.ReadSeeker) (time.Duration, error) {
+	var first [oggHeaderSize - 4]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return 0, ErrInvalidFile
+	}
+	serial := binary.LittleEndian.Uint32(first[10:])
+	segments := int(first[len(first)-1])
+	// skip the segment table: the OpusHead packet starts right after it
+	if _, err := r.Seek(int64(segments), io.SeekCurrent); err != nil {
+		return 0, ErrInvalidFile
+	}
+	head := make([]byte, 19) // "OpusHead", version, channels, pre-skip, ...
+	if _, err := io.ReadFull(r, head); err != nil || string(head[:8]) != "OpusHead" {
+		return 0, ErrUnsupportedFormat
+	}
+	preSkip := int64(binary.LittleEndian.Uint16(head[10:]))
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	start := end - maxOggPageSize
+	if start < 0 {
+		start = 0
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	tail, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	// the last page of the stream with a granule position (-1 means that no packet ends in the page)
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		if len(tail)-i < oggHeaderSize || binary.LittleEndian.Uint32(tail[i+14:]) != serial {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(tail[i+6:]))
+		if granule == -1 {
+			continue
+		}
+		samples := granule - preSkip
+		// samples * time.Second would overflow for a crafted granule position
+		if samples < 0 || samples/opusSampleRate > int64(maxDuration/time.Second) {
+			return 0, ErrInvalidFile
+		}
+		return time.Duration(samples/opusSampleRate)*time.Second +
+			time.Duration(samples%opusSampleRate)*time.Second/opusSampleRate, nil
+	}
+	return 0, ErrInvalidFile
+}
@@ -0,0 +1,122 @@
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wavFile builds a WAV file with the given byte rate, the declared size of the data chunk and dataLen bytes of audio.
+// extra chunks are written before "fmt ".
+func wavFile(byteRate, dataSize uint32, dataLen int, extra ...[]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(0)) // RIFF size, not used
+	b.WriteString("WAVE")
+	for _, c := range extra {
+		b.Write(c)
+	}
+	b.WriteString("fmt ")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(16))
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{1, 1})           // PCM, mono
+	_ = binary.Write(&b, binary.LittleEndian, []uint32{8000, byteRate}) // sample rate, byte rate
+	_ = binary.Write(&b, binary.LittleEndian, []uint16{2, 16})          // block align, bits per sample
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, dataSize)
+	b.Write(make([]byte, dataLen))
+	return b.Bytes()
+}
+
+// chunk builds a RIFF chunk, padded to an even size
+func chunk(id string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(id)
+	_ = binary.Write(&b, binary.LittleEndian, uint32(len(data)))
+	b.Write(data)
+	if len(data)%2 == 1 {
+		b.WriteByte(0)
+	}
+	return b.Bytes()
+}
+
+// oggPage builds an Ogg page with a single segment
+func oggPage(serial uint32, granule int64, payload []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("OggS")
+	b.Write([]byte{0, 0}) // version, header type
+	_ = binary.Write(&b, binary.LittleEndian, granule)
+	_ = binary.Write(&b, binary.LittleEndian, []uint32{serial, 0, 0}) // serial, sequence, checksum (not checked)
+	b.Write([]byte{1, byte(len(payload))})
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// opusHead builds the OpusHead packet of a mono stream
+func opusHead(preSkip uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("OpusHead")
+	b.Write([]byte{1, 1}) // version, channels
+	_ = binary.Write(&b, binary.LittleEndian, preSkip)
+	_ = binary.Write(&b, binary.LittleEndian, uint32(48000))
+	b.Write([]byte{0, 0, 0}) // gain, mapping family
+	return b.Bytes()
+}
+
+// opusFile builds an Ogg Opus file with a pre-skip of 312 samples, followed by pages with the given granule positions
+func opusFile(granules ...int64) []byte {
+	file := oggPage(1, 0, opusHead(312))
+	for _, g := range granules {
+		file = append(file, oggPage(1, g, []byte("audio"))...)
+	}
+	return file
+}
+
+func TestDuration(t *testing.T) {
+	maxSamples := int64(maxDuration/time.Second) * opusSampleRate
+
+	for _, c := range []struct {
+		name string
+		file []byte
+		want time.Duration
+		err  error
+	}{
+		{"empty", nil, 0, ErrUnsupportedFormat},
+		{"unknown format", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), 0, ErrUnsupportedFormat},
+
+		// WAV
+		{"wav", wavFile(16000, 32000, 32000), 2 * time.Second, nil},
+		{"wav fraction", wavFile(16000, 4000, 4000), 250 * time.Millisecond, nil},
+		{"wav with odd chunk", wavFile(16000, 16000, 16000, chunk("LIST", []byte("abc"))), time.Second, nil},
+		{"wav streaming size 0", wavFile(16000, 0, 8000), 500 * time.Millisecond, nil},
+		{"wav streaming size 0xFFFFFFFF", wavFile(16000, 0xFFFFFFFF, 16000), time.Second, nil},
+		{"wav not WAVE", append([]byte("RIFF\x00\x00\x00\x00AVI "), wavFile(16000, 0, 0)[12:]...), 0, ErrUnsupportedFormat},
+		{"wav truncated header", []byte("RIFF\x00\x00"), 0, ErrUnsupportedFormat},
+		{"wav truncated chunk", wavFile(16000, 0, 0)[:30], 0, ErrInvalidFile},
+		{"wav zero byte rate", wavFile(0, 1000, 1000), 0, ErrInvalidFile},
+		{"wav overflowing duration", wavFile(1, 0xFFFFFFFE, 0), 0, ErrInvalidFile},
+		{"wav short fmt", append([]byte("RIFF\x00\x00\x00\x00WAVE"), chunk("fmt ", make([]byte, 8))...), 0, ErrInvalidFile},
+		{"wav data before fmt", append([]byte("RIFF\x00\x00\x00\x00WAVE"), chunk("data", make([]byte, 8))...), 0, ErrInvalidFile},
+		{"wav no data", wavFile(16000, 0, 0)[:36], 0, ErrInvalidFile},
+
+		// Ogg Opus
+		{"opus", opusFile(48000, 96000, 3*48000+312), 3 * time.Second, nil},
+		{"opus fraction", opusFile(24000 + 312), 500 * time.Millisecond, nil},
+		{"opus last page without granule", opusFile(48000+312, -1), time.Second, nil},
+		{"opus other stream", append(opusFile(48000+312), oggPage(2, 10*48000, []byte("x"))...), time.Second, nil},
+		{"opus max duration", opusFile(maxSamples + 312), maxDuration, nil},
+		{"opus over max duration", opusFile(maxSamples + opusSampleRate + 312), 0, ErrInvalidFile},
+		{"opus overflowing granule", opusFile(1 << 62), 0, ErrInvalidFile},
+		{"opus granule before pre-skip", opusFile(100), 0, ErrInvalidFile},
+		{"opus header only", opusFile(), 0, ErrInvalidFile},
+		{"opus truncated header", []byte("OggS\x00\x00\x00"), 0, ErrInvalidFile},
+		{"opus truncated head packet", opusFile()[:35], 0, ErrUnsupportedFormat},
+		{"ogg vorbis", oggPage(1, 0, []byte("\x01vorbis\x00\x00\x00\x00\x01\x44\xac\x00\x00")), 0, ErrUnsupportedFormat},
+	} {
+		got, err := Duration(bytes.NewReader(c.file))
+		if !errors.Is(err, c.err) || got != c.want {
+			t.Errorf("%s: got %v, %v, want %v, %v", c.name, got, err, c.want, c.err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Package blobstore stores binary objects (profile pictures, group pictures, media) outside the database. The database
+keeps only the blob ID.
+
+Blobs are content-addressed: the ID of a blob is the hex-encoded SHA-256 of its content. Identical uploads are stored
+once, and a blob never changes after it has been written. Blobs are never deleted when a reference is removed from the
+database: CollectGarbage removes blobs that are no longer referenced.
+
+Example:
+
+	store, err := blobstore.NewFS("/var/lib/wasatext/blobs")
+	if err != nil {
+		return err
+	}
+	id, size, err := store.Put(r.Body, 10<<20)
+*/
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"time"
+)
+
+var ErrBlobDoesNotExist = errors.New("blob does not exist")
+var ErrBlobTooLarge = errors.New("blob too large")
+var ErrInvalidBlobID = errors.New("invalid blob ID")
+
+// BlobStore is the interface for a content-addressed blob storage
+type BlobStore interface {
+	// Put streams the content of r into the store and returns its ID and size. If maxSize is greater than zero and
+	// the content is larger, nothing is stored and ErrBlobTooLarge is returned.
+	Put(r io.Reader, maxSize int64) (string, int64, error)
+
+	// Open returns the content of the blob. The caller must close it.
+	Open(id string) (io.ReadSeekCloser, error)
+
+	// Stat returns the metadata of the blob.
+	Stat(id string) (Info, error)
+
+	// Delete removes the blob.
+	Delete(id string) error
+
+	// List returns the metadata of all blobs in the store.
+	List() ([]Info, error)
+}
+
+// Info describes a stored blob
+type Info struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+var blobIDRx = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidID reports whether id is a well-formed blob ID. IDs coming from clients must be checked before use.
+func ValidID(id string) bool {
+	return blobIDRx.MatchString(id)
+}
@@ -0,0 +1,143 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// fsStore is a BlobStore on the local filesystem. Blob `id` is saved as `root/id[0:2]/id`; uploads are written in
+// `root/tmp` and then renamed, so a partially written blob is never visible.
+type fsStore struct {
+	root string
+}
+
+// NewFS returns a BlobStore that saves blobs in the `root` directory, creating it if needed.
+func NewFS(root string) (BlobStore, error) {
+	if root == "" {
+		return nil, errors.New("blob store directory is required")
+	}
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0o750); err != nil {
+		return nil, fmt.Errorf("creating blob store directory: %w", err)
+	}
+	return &fsStore{root: root}, nil
+}
+
+func (s *fsStore) path(id string) string {
+	return filepath.Join(s.root, id[:2], id)
+}
+
+func (s *fsStore) Put(r io.Reader, maxSize int64) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if maxSize > 0 && size > maxSize {
+		return "", 0, ErrBlobTooLarge
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	id := hex.EncodeToString(h.Sum(nil))
+	dst := s.path(id)
+	if _, err := os.Stat(dst); err == nil {
+		// Stesso contenuto già presente: aggiorno solo la data, così il garbage collector non lo rimuove prima
+		// che venga salvato il riferimento
+		now := globaltime.Now()
+		return id, size, os.Chtimes(dst, now, now)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", 0, err
+	}
+	return id, size, nil
+}
+
+func (s *fsStore) Open(id string) (io.ReadSeekCloser, error) {
+	if !ValidID(id) {
+		return nil, ErrInvalidBlobID
+	}
+	f, err := os.Open(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobDoesNotExist
+	}
+	return f, err
+}
+
+func (s *fsStore) Stat(id string) (Info, error) {
+	if !ValidID(id) {
+		return Info{}, ErrInvalidBlobID
+	}
+	st, err := os.Stat(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Info{}, ErrBlobDoesNotExist
+	} else if err != nil {
+		return Info{}, err
+	}
+	return Info{ID: id, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s *fsStore) Delete(id string) error {
+	if !ValidID(id) {
+		return ErrInvalidBlobID
+	}
+	err := os.Remove(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrBlobDoesNotExist
+	}
+	return err
+}
+
+func (s *fsStore) List() ([]Info, error) {
+	dirs, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []Info
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.root, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !ValidID(e.Name()) {
+				continue
+			}
+			st, err := e.Info()
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, Info{ID: e.Name(), Size: st.Size(), ModTime: st.ModTime()})
+		}
+	}
+	return blobs, nil
+}
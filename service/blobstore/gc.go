@@ -0,0 +1,26 @@
+package blobstore
+
+import (
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"time"
+)
+
+// CollectGarbage deletes every blob that is not in `referenced` and is older than `grace`. The grace period protects
+// blobs that have just been uploaded and whose reference has not been saved yet. It returns the number of deleted blobs.
+func CollectGarbage(store BlobStore, referenced map[string]bool, grace time.Duration) (int, error) {
+	blobs, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, b := range blobs {
+		if referenced[b.ID] || globaltime.Since(b.ModTime) < grace {
+			continue
+		}
+		if err := store.Delete(b.ID); err != nil && err != ErrBlobDoesNotExist {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
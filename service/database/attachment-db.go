@@ -0,0 +1,55 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+
+// Tipi dei messaggi con un file allegato (MessageContent.File)
+const (
+	MessageTypeFile  = "file"
+	MessageTypeAudio = "audio"
+)
+
+// attachmentBlob ritorna i valori delle colonne blob_id e blob_size per il contenuto di un messaggio: NULL se il
+// messaggio non ha un file allegato.
+func attachmentBlob(content MessageContent) (sql.NullString, sql.NullInt64) {
+	if content.File == nil || content.File.BlobID == "" {
+		return sql.NullString{}, sql.NullInt64{}
+	}
+	return sql.NullString{String: content.File.BlobID, Valid: true}, sql.NullInt64{Int64: content.File.Size, Valid: true}
+}
+
+// storageQuery calcola lo spazio occupato dai file inviati da un utente e se tra questi c'è già un blob. Parametri: ID
+// del blob, ID dell'utente.
+const storageQuery = `
+	SELECT COALESCE(SUM(blob_size), 0), COALESCE(MAX(blob_id = ?), 0)
+	  FROM (SELECT DISTINCT blob_id, blob_size FROM messages WHERE sender_id = ? AND blob_id IS NOT NULL)`
+
+// GetUserStorage ritorna lo spazio occupato dai file allegati ai messaggi inviati dall'utente. Lo stesso file inviato
+// (o inoltrato) più volte conta una volta sola, come nel blob store.
+func (db *appdbimpl) GetUserStorage(userID uint64) (int64, error) {
+	var used int64
+	var found bool
+	err := db.c.QueryRow(storageQuery, "", userID).Scan(&used, &found)
+	return used, err
+}
+
+// checkStorageQuota controlla, nella stessa transazione dell'inserimento, che il file `blobID` inviato da `senderID`
+// non gli faccia superare `quota` (0: nessun limite). Un file che l'utente ha già inviato non occupa altro spazio.
+func checkStorageQuota(tx *sql.Tx, senderID string, blobID sql.NullString, blobSize sql.NullInt64, quota int64) error {
+	if quota <= 0 || !blobID.Valid {
+		return nil
+	}
+	var used int64
+	var found bool
+	if err := tx.QueryRow(storageQuery, blobID.String, senderID).Scan(&used, &found); err != nil {
+		return err
+	}
+	if !found && used+blobSize.Int64 > quota {
+		return ErrStorageQuotaExceeded
+	}
+	return nil
+}
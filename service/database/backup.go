@@ -0,0 +1,67 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrBackupTargetNotEmpty = errors.New("backup target already exists and is not empty")
+var ErrIntegrityCheckFailed = errors.New("integrity check failed")
+
+// Backup copia a caldo il database aperto su `c` nel file `dst` usando VACUUM INTO. La copia è consistente anche se
+// il server sta scrivendo, perché SQLite la esegue dentro una transazione di lettura.
+// `dst` deve non esistere oppure essere un file vuoto.
+func Backup(c *sql.DB, dst string) error {
+	if err := checkEmptyTarget(dst); err != nil {
+		return err
+	}
+	if _, err := c.Exec(`VACUUM INTO ?`, dst); err != nil {
+		return fmt.Errorf("vacuum into %q: %w", dst, err)
+	}
+	return nil
+}
+
+// CheckIntegrity esegue PRAGMA integrity_check e ritorna ErrIntegrityCheckFailed (con i problemi riportati da SQLite)
+// se il database non è integro.
+func CheckIntegrity(c *sql.DB) error {
+	rows, err := c.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrIntegrityCheckFailed, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkEmptyTarget verifica che il file di destinazione non esista o sia vuoto, come richiesto da VACUUM INTO.
+func checkEmptyTarget(dst string) error {
+	st, err := os.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if st.IsDir() || st.Size() > 0 {
+		return fmt.Errorf("%w: %s", ErrBackupTargetNotEmpty, dst)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+// GetBlobReferences ritorna l'insieme degli ID dei blob ancora referenziati dal database. Tutti gli altri blob
+// possono essere rimossi dal garbage collector.
+func (db *appdbimpl) GetBlobReferences() (map[string]bool, error) {
+	rows, err := db.c.Query(`
+		SELECT photo_id FROM users  WHERE photo_id IS NOT NULL
+		UNION
+		SELECT photo_id FROM groups WHERE photo_id IS NOT NULL
+		UNION
+		SELECT blob_id  FROM exports WHERE blob_id IS NOT NULL
+		UNION
+		SELECT blob_id  FROM messages WHERE blob_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		refs[id] = true
+	}
+	return refs, rows.Err()
+}
+
+// MigrateInlinePhotos sposta nel blob store (tramite `store`) le foto salvate come BLOB nella colonna `photo` dalle
+// versioni precedenti dello schema, e salva al loro posto il riferimento. Ritorna il numero di foto spostate.
+func (db *appdbimpl) MigrateInlinePhotos(store func(io.Reader) (string, error)) (int, error) {
+	tables := []struct{ table, key string }{
+		{"users", "id"},
+		{"groups", "group_id"},
+	}
+	migrated := 0
+	for _, t := range tables {
+		var n int
+		if err := db.c.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = 'photo'`, t.table).Scan(&n); err != nil {
+			return migrated, err
+		}
+		if n == 0 {
+			// schema nuovo, nessuna foto da spostare
+			continue
+		}
+
+		for {
+			// una foto alla volta, per non caricarle tutte in memoria
+			var key string
+			var photo []byte
+			err := db.c.QueryRow(fmt.Sprintf(
+				`SELECT %s, photo FROM %s WHERE photo IS NOT NULL AND photo_id IS NULL LIMIT 1`, t.key, t.table),
+			).Scan(&key, &photo)
+			if err == sql.ErrNoRows {
+				break
+			} else if err != nil {
+				return migrated, err
+			}
+
+			id, err := store(bytes.NewReader(photo))
+			if err != nil {
+				return migrated, err
+			}
+			if _, err := db.c.Exec(fmt.Sprintf(
+				`UPDATE %s SET photo_id = ?, photo = NULL WHERE %s = ?`, t.table, t.key), id, key); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+	}
+	return migrated, nil
+}
@@ -1,15 +1,43 @@
 package database
 
 import (
-	"time"
+	"database/sql"
+	"strings"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
 )
 
+// ReactionSummary raggruppa le reaction di un messaggio con la stessa emoji.
+type ReactionSummary struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+// CommentMessage aggiunge la reaction `emoji` dell'utente al messaggio. Ogni utente può usare ogni emoji una sola
+// volta per messaggio: se la reaction c'è già non succede nulla.
 func (db *appdbimpl) CommentMessage(conversationId string, messageId string, emoji string, userID uint64) error {
-	// Inserisce una nuova emoji reaction (comment) nella tabella comments
-	res, err := db.c.Exec(
+	if err := db.checkMessageInConversation(conversationId, messageId); err != nil {
+		return err
+	}
+
+	_, err := db.c.Exec(
 		`INSERT INTO comments (conversation_id, message_id, emoji, user_id, timestamp)
-         VALUES (?, ?, ?, ?, ?)`,
-		conversationId, messageId, emoji, userID, time.Now())
+         VALUES (?, ?, ?, ?, ?)
+         ON CONFLICT(message_id, user_id, emoji) DO NOTHING`,
+		conversationId, messageId, emoji, userID, globaltime.Now())
+	return err
+}
+
+// UncommentMessage toglie la reaction `emoji` dell'utente dal messaggio; se emoji è vuota le toglie tutte.
+func (db *appdbimpl) UncommentMessage(conversationId string, messageId string, userID uint64, emoji string) error {
+	query := `DELETE FROM comments WHERE conversation_id = ? AND message_id = ? AND user_id = ?`
+	args := []interface{}{conversationId, messageId, userID}
+	if emoji != "" {
+		query += ` AND emoji = ?`
+		args = append(args, emoji)
+	}
+	res, err := db.c.Exec(query, args...)
 	if err != nil {
 		return err
 	}
@@ -22,19 +50,105 @@ func (db *appdbimpl) CommentMessage(conversationId string, messageId string, emo
 	return nil
 }
 
-func (db *appdbimpl) UncommentMessage(conversationId string, messageId string, userID uint64) error {
-	// Elimina l'emoji reaction (comment) dalla tabella comments
-	res, err := db.c.Exec(
-		`DELETE FROM comments WHERE conversation_id = ? AND message_id = ? AND user_id = ?`,
-		conversationId, messageId, userID)
+// GetComments ritorna tutte le reaction del messaggio con l'autore, dalla più vecchia.
+func (db *appdbimpl) GetComments(conversationId string, messageId string) ([]Comment, error) {
+	if err := db.checkMessageInConversation(conversationId, messageId); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.c.Query(
+		`SELECT c.emoji, c.user_id, COALESCE(u.username, ''), c.timestamp
+		   FROM comments c LEFT JOIN users u ON u.id = c.user_id
+		  WHERE c.message_id = ?
+		  ORDER BY c.timestamp, c.id`, messageId)
 	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []Comment
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.Emoji, &c.UserID, &c.Username, &c.Timestamp); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// checkMessageInConversation ritorna ErrMessageDoesNotExist se il messaggio non esiste o non fa parte della
+// conversazione.
+func (db *appdbimpl) checkMessageInConversation(conversationId string, messageId string) error {
+	var exists bool
+	if err := db.c.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM messages WHERE id = ? AND conversation_id = ? AND `+notExpired+`)`,
+		messageId, conversationId, expiryNow()).Scan(&exists); err != nil {
 		return err
+	} else if !exists {
+		return ErrMessageDoesNotExist
 	}
-	affected, err := res.RowsAffected()
+	return nil
+}
+
+// reactionSummaries raggruppa per emoji le reaction dei messaggi `ids`, nell'ordine in cui ogni emoji è stata usata la
+// prima volta. ReactedByMe si riferisce all'utente `userID`.
+func reactionSummaries(c *sql.DB, ids []int, userID uint64) (map[int][]ReactionSummary, error) {
+	summaries := make(map[int][]ReactionSummary, len(ids))
+	if len(ids) == 0 {
+		return summaries, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{userID}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := c.Query(
+		`SELECT message_id, emoji, COUNT(*), MAX(user_id = ?)
+		   FROM comments
+		  WHERE message_id IN (`+placeholders+`)
+		  GROUP BY message_id, emoji
+		  ORDER BY message_id, MIN(id)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var s ReactionSummary
+		if err := rows.Scan(&id, &s.Emoji, &s.Count, &s.ReactedByMe); err != nil {
+			return nil, err
+		}
+		summaries[id] = append(summaries[id], s)
+	}
+	return summaries, rows.Err()
+}
+
+// fillReactions imposta le reaction raggruppate dei messaggi, i cui ID sono `ids`, dal punto di vista di `userID`.
+func fillReactions(c *sql.DB, messages []Message, ids []int, userID uint64) error {
+	summaries, err := reactionSummaries(c, ids, userID)
 	if err != nil {
 		return err
-	} else if affected == 0 {
-		return ErrCommentDoesNotExist
+	}
+	for i := range messages {
+		messages[i].Reactions = summaries[messages[i].ID]
+		if messages[i].Reactions == nil {
+			messages[i].Reactions = []ReactionSummary{}
+		}
 	}
 	return nil
 }
+
+// migrateUniqueComments toglie le reaction duplicate (stesso utente, messaggio ed emoji) rimaste dalle versioni che
+// non le impedivano, tenendo la prima, e crea l'indice che le impedisce.
+func migrateUniqueComments(c *sql.DB) error {
+	if _, err := c.Exec(
+		`DELETE FROM comments
+		  WHERE id NOT IN (SELECT MIN(id) FROM comments GROUP BY message_id, user_id, emoji)`); err != nil {
+		return err
+	}
+	_, err := c.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS comments_unique_reaction ON comments (message_id, user_id, emoji)`)
+	return err
+}
@@ -2,17 +2,62 @@ package database
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
 )
 
 var ErrConversationDoesNotExist = errors.New("conversation does not exist")
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// conversationColumns sono le colonne lette da scanConversation: la conversazione con l'autore dell'ultimo messaggio e
+// i dati dell'eventuale gruppo
+const conversationColumns = `c.conversation_id, c.participants, COALESCE(c.last_message, ''), COALESCE(lu.username, ''),
+	c.last_activity, g.group_id IS NOT NULL, COALESCE(g.group_name, ''), COALESCE(g.photo_id, ''), c.disappearing_timer`
+
+// conversationFrom è la FROM da usare con conversationColumns
+const conversationFrom = `conversations c
+	LEFT JOIN groups g ON g.group_id = c.conversation_id
+	LEFT JOIN users lu ON lu.id = c.last_sender_id`
+
+// activityKey ordina le conversazioni per ultima attività; quelle senza attività vengono per ultime
+const activityKey = `COALESCE(julianday(c.last_activity), 0)`
+
+// scanConversation legge una riga con le colonne conversationColumns. Le colonne che nella query seguono
+// conversationColumns vengono lette in `extra`.
+func scanConversation(row rowScanner, extra ...interface{}) (Conversation, error) {
+	var conv Conversation
+	var participantsStr string
+	var lastActivity sql.NullTime
+	dest := append([]interface{}{&conv.ConversationID, &participantsStr, &conv.LastMessage, &conv.LastSender,
+		&lastActivity, &conv.IsGroup, &conv.GroupName, &conv.GroupPhoto, &conv.DisappearingTimer}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return conv, err
+	}
+	// Converti la stringa dei partecipanti in slice (assumendo separazione tramite virgola)
+	conv.Participants = strings.Split(participantsStr, ",")
+	if lastActivity.Valid {
+		conv.LastActivity = &lastActivity.Time
+	}
+	return conv, nil
+}
+
+// GetConversations ritorna tutte le conversazioni dell'utente, dalla più recente.
 func (db *appdbimpl) GetConversations(username string) ([]Conversation, error) {
+	if err := db.refreshExpiredPreviews(); err != nil {
+		return nil, err
+	}
 	rows, err := db.c.Query(
-       	`SELECT conversation_id, participants, COALESCE(last_message, '') AS last_message
-          FROM conversations
-         WHERE ',' || participants || ',' LIKE '%,' || ? || ',%'`,
+       	`SELECT `+conversationColumns+`
+          FROM `+conversationFrom+`
+         WHERE instr(',' || c.participants || ',', ',' || ? || ',') > 0
+         ORDER BY `+activityKey+` DESC, c.conversation_id DESC`,
        	username)
 	if err != nil {
 		return nil, err
@@ -21,13 +66,10 @@ func (db *appdbimpl) GetConversations(username string) ([]Conversation, error) {
 
 	var conversations []Conversation
 	for rows.Next() {
-		var conv Conversation
-		var participantsStr string
-		if err := rows.Scan(&conv.ConversationID, &participantsStr, &conv.LastMessage); err != nil {
+		conv, err := scanConversation(rows)
+		if err != nil {
 			return nil, err
 		}
-		// Converti la stringa dei partecipanti in slice (assumendo separazione tramite virgola)
-		conv.Participants = strings.Split(participantsStr, ",")
 		conversations = append(conversations, conv)
 	}
 	if err = rows.Err(); err != nil {
@@ -37,42 +79,338 @@ func (db *appdbimpl) GetConversations(username string) ([]Conversation, error) {
 }
 
 func (db *appdbimpl) GetConversation(conversationId string) (Conversation, error) {
-    var conv Conversation
-    var participantsStr string
-
+    if err := db.refreshExpiredPreviews(); err != nil {
+        return Conversation{}, err
+    }
     // COALESCE sostituisce NULL con stringa vuota
-    err := db.c.QueryRow(
-        `SELECT conversation_id,
-                participants,
-                COALESCE(last_message, '') AS last_message
-           FROM conversations
-          WHERE conversation_id = ?`,
+    conv, err := scanConversation(db.c.QueryRow(
+        `SELECT `+conversationColumns+`
+           FROM `+conversationFrom+`
+          WHERE c.conversation_id = ?`,
         conversationId,
-    ).Scan(&conv.ConversationID, &participantsStr, &conv.LastMessage)
+    ))
     if err != nil {
         if err == sql.ErrNoRows {
             return conv, ErrConversationDoesNotExist
         }
         return conv, err
     }
-
-    conv.Participants = strings.Split(participantsStr, ",")
     return conv, nil
 }
 
-func (db *appdbimpl) CreateConversation(conversationId string, participants []string) (Conversation, error) {
-    participantsStr := strings.Join(participants, ",")
-    _, err := db.c.Exec(
-        `INSERT INTO conversations (conversation_id, participants, last_message)
-         VALUES (?, ?, NULL)`,
-        conversationId, participantsStr,
-    )
-    if err != nil {
-        return Conversation{}, err
-    }
-    return Conversation{
-    	ConversationID: conversationId,
-    	Participants:   participants,
-    	LastMessage:    "",
-	}, nil
+// CreateConversation crea una nuova conversazione (non di gruppo) tra i partecipanti `participants`, con un ID
+// generato dal server. Se uno dei partecipanti non esiste ritorna un errore ErrUserDoesNotExist con il suo username.
+func (db *appdbimpl) CreateConversation(participants []string) (Conversation, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := checkUsersExist(tx, participants); err != nil {
+		return Conversation{}, err
+	}
+
+	// come per i gruppi, un prefisso più il timestamp UNIX
+	conversationId := fmt.Sprintf("conv%d", time.Now().UnixNano())
+	if _, err := tx.Exec(
+		`INSERT INTO conversations (conversation_id, participants, last_message, last_activity) VALUES (?, ?, NULL, ?)`,
+		conversationId, strings.Join(participants, ","), globaltime.Now()); err != nil {
+		return Conversation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return db.GetConversation(conversationId)
+}
+
+// GetOrCreateDirectConversation ritorna la conversazione diretta (non di gruppo) tra gli utenti `username` e
+// `otherUsername`, creandola se non esiste ancora. La conversazione creata ha un ID derivato dagli ID dei due utenti,
+// così due richieste contemporanee non creano due conversazioni; se quell'ID è già usato da un'altra conversazione
+// l'ID è generato come in CreateConversation. Se uno dei due utenti non esiste ritorna ErrUserDoesNotExist.
+func (db *appdbimpl) GetOrCreateDirectConversation(username string, otherUsername string) (Conversation, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Conversation{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var ids [2]uint64
+	for i, name := range []string{username, otherUsername} {
+		err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, name).Scan(&ids[i])
+		if err == sql.ErrNoRows {
+			return Conversation{}, ErrUserDoesNotExist
+		} else if err != nil {
+			return Conversation{}, err
+		}
+	}
+
+	// una conversazione diretta già esistente, creata anche con un ID scelto dal client
+	var conversationId string
+	err = tx.QueryRow(
+		`SELECT conversation_id FROM conversations c
+		  WHERE c.participants IN (?, ?)
+		    AND NOT EXISTS (SELECT 1 FROM groups g WHERE g.group_id = c.conversation_id)
+		  ORDER BY c.rowid LIMIT 1`,
+		username+","+otherUsername, otherUsername+","+username).Scan(&conversationId)
+	if err == sql.ErrNoRows {
+		if ids[0] > ids[1] {
+			ids[0], ids[1] = ids[1], ids[0]
+		}
+		conversationId = fmt.Sprintf("direct%d-%d", ids[0], ids[1])
+		res, err := tx.Exec(
+			`INSERT INTO conversations (conversation_id, participants, last_message, last_activity) VALUES (?, ?, NULL, ?)
+			 ON CONFLICT(conversation_id) DO NOTHING`,
+			conversationId, username+","+otherUsername, globaltime.Now())
+		if err != nil {
+			return Conversation{}, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return Conversation{}, err
+		} else if n == 0 {
+			// l'ID esiste già: va bene se è la stessa coppia (creata nel frattempo), ma prima che gli ID li scegliesse
+			// il server un client può averlo usato per una conversazione con altri partecipanti
+			var participants string
+			if err := tx.QueryRow(`SELECT participants FROM conversations WHERE conversation_id = ?`,
+				conversationId).Scan(&participants); err != nil {
+				return Conversation{}, err
+			}
+			if participants != username+","+otherUsername && participants != otherUsername+","+username {
+				conversationId = fmt.Sprintf("conv%d", time.Now().UnixNano())
+				if _, err := tx.Exec(
+					`INSERT INTO conversations (conversation_id, participants, last_message, last_activity) VALUES (?, ?, NULL, ?)`,
+					conversationId, username+","+otherUsername, globaltime.Now()); err != nil {
+					return Conversation{}, err
+				}
+			}
+		}
+	} else if err != nil {
+		return Conversation{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Conversation{}, err
+	}
+	return db.GetConversation(conversationId)
+}
+
+// refreshLastMessage ricalcola l'anteprima, l'autore e l'ora dell'ultimo messaggio della conversazione dall'ultimo
+// messaggio rimasto. Va chiamata dopo ogni messaggio inviato o cancellato. Se non resta nessun messaggio l'ultima
+// attività non cambia.
+func refreshLastMessage(tx *sql.Tx, conversationId string) error {
+	m, err := scanMessage(tx.QueryRow(
+		`SELECT `+messageColumns+` FROM messages
+		  WHERE conversation_id = ? AND parent_id IS NULL AND `+notExpired+`
+		  ORDER BY id DESC LIMIT 1`,
+		conversationId, expiryNow()))
+	var lastMessage, lastSender, lastActivity, lastExpiresAt interface{}
+	if err == nil {
+		lastMessage, lastSender, lastActivity = previewText(m.MessageContent), m.SenderID, m.Timestamp
+		if m.ExpiresAt != nil {
+			lastExpiresAt = *m.ExpiresAt
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE conversations
+		    SET last_message = ?, last_sender_id = ?, last_activity = COALESCE(?, last_activity), last_expires_at = ?
+		  WHERE conversation_id = ?`,
+		lastMessage, lastSender, lastActivity, lastExpiresAt, conversationId)
+	return err
+}
+
+// refreshExpiredPreviews ricalcola l'ultimo messaggio delle conversazioni in cui è un messaggio effimero già scaduto.
+// Viene chiamata prima di leggere le conversazioni, così l'anteprima di un messaggio scaduto sparisce subito, anche se
+// il messaggio non è ancora stato cancellato (o se la cancellazione periodica è spenta).
+func (db *appdbimpl) refreshExpiredPreviews() error {
+	rows, err := db.c.Query(
+		`SELECT conversation_id FROM conversations
+		  WHERE last_expires_at IS NOT NULL AND julianday(last_expires_at) <= julianday(?)`, expiryNow())
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return err
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	for _, id := range ids {
+		if err := refreshLastMessage(tx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateLastActivity calcola l'ultimo messaggio delle conversazioni create dalle versioni precedenti, che non lo
+// aggiornavano.
+func migrateLastActivity(c *sql.DB) error {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`SELECT conversation_id FROM conversations WHERE last_activity IS NULL`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := refreshLastMessage(tx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// maxPreviewLength è la lunghezza massima (in caratteri) dell'anteprima di un messaggio
+const maxPreviewLength = 100
+
+// previewText ritorna il testo da mostrare come anteprima del messaggio nella lista delle conversazioni.
+func previewText(content MessageContent) string {
+	switch content.Type {
+	case "text":
+		return truncatePreview(content.Text)
+	case "image":
+		return "📷 Image"
+	case MessageTypeFile:
+		if content.File != nil {
+			return truncatePreview("📎 " + content.File.Name)
+		}
+	case MessageTypeAudio:
+		return "🎤 Voice message"
+	case MessageTypePoll:
+		if content.Poll != nil {
+			return truncatePreview("📊 " + content.Poll.Question)
+		}
+	case MessageTypeSystem:
+		if content.System != nil {
+			return content.System.Summary()
+		}
+	}
+	return ""
+}
+
+// truncatePreview accorcia il testo a maxPreviewLength caratteri.
+func truncatePreview(s string) string {
+	text := []rune(s)
+	if len(text) > maxPreviewLength {
+		return string(text[:maxPreviewLength-1]) + "…"
+	}
+	return s
+}
+
+// GetConversationList ritorna al più `limit` conversazioni dell'utente, dalla più recente attività. Ogni conversazione
+// ha il numero di messaggi non letti (quelli degli altri dopo il cursore di lettura dell'utente), se tra questi c'è
+// una menzione non letta e se l'utente ha una bozza. `cursor` è il valore next ritornato dalla pagina precedente
+// (vuoto per la prima); next è vuoto se non ci sono altre pagine.
+func (db *appdbimpl) GetConversationList(user User, cursor string, limit int) (conversations []Conversation, next string, err error) {
+	if err := db.refreshExpiredPreviews(); err != nil {
+		return nil, "", err
+	}
+	now := expiryNow()
+	query := `SELECT ` + conversationColumns + `,
+		       (SELECT COUNT(*) FROM messages
+		         WHERE messages.conversation_id = c.conversation_id AND messages.parent_id IS NULL
+		           AND messages.id > COALESCE(rc.last_read_id, 0) AND messages.sender_id <> ? AND ` + notExpired + `),
+		       EXISTS (SELECT 1 FROM mentions mt JOIN messages ON messages.id = mt.message_id
+		                WHERE mt.conversation_id = c.conversation_id AND mt.user_id = ? AND mt.read_at IS NULL
+		                  AND mt.message_id > COALESCE(rc.last_read_id, 0) AND ` + notExpired + `),
+		       EXISTS (SELECT 1 FROM drafts d
+		                WHERE d.conversation_id = c.conversation_id AND d.user_id = ? AND d.text <> ''),
+		       ` + activityKey + `
+		  FROM ` + conversationFrom + `
+		  LEFT JOIN read_cursors rc ON rc.conversation_id = c.conversation_id AND rc.user_id = ?
+		 WHERE instr(',' || c.participants || ',', ',' || ? || ',') > 0`
+	args := []interface{}{user.ID, now, user.ID, now, user.ID, user.ID, user.CurrentUsername}
+	if cursor != "" {
+		activity, id, err := parseConversationCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query += ` AND (` + activityKey + ` < ? OR (` + activityKey + ` = ? AND c.conversation_id < ?))`
+		args = append(args, activity, activity, id)
+	}
+	// una riga in più per sapere se c'è un'altra pagina
+	query += ` ORDER BY ` + activityKey + ` DESC, c.conversation_id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var keys []float64
+	for rows.Next() {
+		var activity float64
+		var unread int
+		var mention, draft bool
+		conv, err := scanConversation(rows, &unread, &mention, &draft, &activity)
+		if err != nil {
+			return nil, "", err
+		}
+		conv.UnreadCount, conv.HasMention, conv.HasDraft = unread, mention, draft
+		conversations = append(conversations, conv)
+		keys = append(keys, activity)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(conversations) > limit {
+		conversations = conversations[:limit]
+		next = conversationCursor(keys[limit-1], conversations[limit-1].ConversationID)
+	}
+	return conversations, next, nil
+}
+
+// conversationCursor codifica la posizione di una conversazione nella lista: la chiave dell'ultima attività e l'ID,
+// che separa le conversazioni con la stessa attività.
+func conversationCursor(activity float64, conversationId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatFloat(activity, 'g', -1, 64) + " " + conversationId))
+}
+
+// parseConversationCursor decodifica un cursore creato da conversationCursor, o ritorna ErrInvalidCursor.
+func parseConversationCursor(cursor string) (float64, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), " ", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrInvalidCursor
+	}
+	activity, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return activity, parts[1], nil
 }
@@ -34,8 +34,8 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"time"
-	"mime/multipart"
 )
 
 type User struct {
@@ -49,34 +49,56 @@ type Profile struct {
 	RequestID		int    `json:"request_id"`
 }
 
+// Conversation is a chat between participants. The conversation of a group has the same ID of the group, and its
+// participants are the group members.
 type Conversation struct {
-	ConversationID string   `json:"conversation_id"`
-	Participants   []string `json:"participants"`
-	LastMessage    string   `json:"last_message,omitempty"` // omitempty allows the field to be optional
+	ConversationID    string   `json:"conversation_id"`
+	Participants      []string `json:"participants"`
+	LastMessage       string     `json:"last_message,omitempty"` // preview of the last message
+	LastSender        string     `json:"last_sender,omitempty"`  // username of the sender of the last message
+	LastActivity      *time.Time `json:"last_activity,omitempty"`
+	IsGroup           bool       `json:"is_group"`
+	GroupName         string     `json:"group_name,omitempty"`
+	GroupPhoto        string     `json:"group_photo,omitempty"` // blob ID of the group picture
+	DisappearingTimer string     `json:"disappearing_timer"`    // lifetime of new messages: "off", "1h", "1d" or "7d"
+
+	// only in the conversation list of the user
+	UnreadCount int  `json:"unread_count,omitempty"`
+	HasMention  bool `json:"has_mention,omitempty"` // unread messages mention the user
+	HasDraft    bool `json:"has_draft,omitempty"`
 }
 
 // Message represents a single message in a conversation.
 type Message struct {
-	ID             int            `json:"id"`
-	Timestamp      time.Time      `json:"timestamp"`
-	Preview        MessagePreview `json:"preview"`
-	Comments       []Comment      `json:"comments"`
-	MessageStatus  MessageStatus  `json:"message_status"`
-	MessageContent MessageContent `json:"message_content"`
-	SenderID       string         `json:"sender_id"`
+	ID             int               `json:"id"`
+	ConversationID string            `json:"conversation_id,omitempty"`
+	Timestamp      time.Time         `json:"timestamp"`
+	Preview        MessagePreview    `json:"preview"`
+	Comments       []Comment         `json:"comments,omitempty"`
+	Reactions      []ReactionSummary `json:"reactions"`           // reaction raggruppate per emoji
+	ParentID       int               `json:"parent_id,omitempty"` // solo per le risposte in un thread
+	ReplyCount     int               `json:"reply_count"`
+	LastReplyAt    *time.Time        `json:"last_reply_at,omitempty"`
+	ExpiresAt      *time.Time        `json:"expires_at,omitempty"` // solo per i messaggi effimeri
+	MessageStatus  MessageStatus     `json:"message_status"`
+	MessageContent MessageContent    `json:"message_content"`
+	SenderID       string            `json:"sender_id"`
 }
 
 // MessagePreview represents the preview of a message.
 type MessagePreview struct {
-	Type         string `json:"type"` // "text" or "image"
-	Content      string `json:"content"`
-	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Type         string `json:"type"` // "text", "image" or "link"
+	Content      string `json:"content"`                 // for "link", the URL of the page
+	ThumbnailURL string `json:"thumbnail_url,omitempty"` // for "link", the image of the page
+	Title        string `json:"title,omitempty"`         // only for "link"
+	Description  string `json:"description,omitempty"`   // only for "link"
 }
 
 // Comment represents an emoji reaction to a message.
 type Comment struct {
 	Emoji     string    `json:"emoji"`
 	UserID    int       `json:"user_id"`
+	Username  string    `json:"username,omitempty"`
 	Timestamp time.Time `json:"timestamp"`
 }
 
@@ -89,15 +111,83 @@ type MessageStatus struct {
 
 // MessageContent represents the content of a message.
 type MessageContent struct {
-	Type     string `json:"type"` // "text" or "image"
-	Text     string `json:"text,omitempty"`
-	ImageURL string `json:"image_url,omitempty"`
+	Type          string         `json:"type"` // "text", "image", "file", "audio", "poll" or "system"
+	Text          string         `json:"text,omitempty"`
+	Format        string         `json:"format,omitempty"` // "markdown" if Text was written with markdown-lite syntax
+	ImageURL      string         `json:"image_url,omitempty"`
+	File          *Attachment    `json:"file,omitempty"`           // only for "file" and "audio" messages
+	Poll          *Poll          `json:"poll,omitempty"`           // only for "poll" messages
+	Entities      []Entity       `json:"entities,omitempty"`       // mentions and formatting of the text
+	System        *SystemEvent   `json:"system,omitempty"`         // only for "system" messages
+	ForwardedFrom *ForwardOrigin `json:"forwarded_from,omitempty"` // only for forwarded messages
+}
+
+// ForwardOrigin is where a forwarded message was first sent. ConversationID and MessageID are empty if the participants
+// of the conversation where the message was forwarded are not all participants of the original conversation.
+type ForwardOrigin struct {
+	SenderID       string    `json:"sender_id"`
+	SenderUsername string    `json:"sender_username,omitempty"`
+	ConversationID string    `json:"conversation_id,omitempty"`
+	MessageID      int       `json:"message_id,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Attachment is the file of a "file" or "audio" message. The content is in the blob store: BlobID is saved in the
+// messages table, not in the JSON content, and is never sent to clients.
+type Attachment struct {
+	BlobID      string `json:"-"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	DurationMs  int64  `json:"duration_ms,omitempty"` // only for "audio", if the format is known
+}
+
+// Entity is a part of the text of a message with a special meaning, such as a mention or bold text. Offset and
+// Length count Unicode code points of MessageContent.Text.
+type Entity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	UserID   uint64 `json:"user_id,omitempty"`  // only for "mention"
+	Username string `json:"username,omitempty"` // only for "mention"
+	URL      string `json:"url,omitempty"`      // only for "link"
+}
+
+// Types of the entities of a message
+const (
+	EntityMention       = "mention"
+	EntityMentionAll    = "mention_all"
+	EntityBold          = "bold"
+	EntityItalic        = "italic"
+	EntityStrikethrough = "strikethrough"
+	EntityCode          = "code"
+	EntityPre           = "pre" // code block
+	EntityLink          = "link"
+)
+
+// FormatMarkdown is the MessageContent.Format of the text messages written with markdown-lite syntax
+const FormatMarkdown = "markdown"
+
+// Group represents a group of users. Owners and Admins are the members with that role; the other members are plain
+// members.
+type Group struct {
+	GroupID          string           `json:"group_id"`
+	Name             string           `json:"group_name"`
+	Description      string           `json:"description,omitempty"`
+	CreatorID        uint64           `json:"creator_id"`
+	Members          []string         `json:"members"`
+	Owners           []string         `json:"owners"`
+	Admins           []string         `json:"admins"`
+	Permissions      GroupPermissions `json:"permissions"`
+	PhotoID          string           `json:"photo_id,omitempty"`
+	AnnouncementOnly bool             `json:"announcement_only"` // only owners and admins can send messages
 }
 
+// Photo is a profile picture. The content is kept in the blob store, the database saves only BlobID.
 type Photo struct {
 	Id            uint64 `json:"id"`
 	UserId        uint64 `json:"userId"`
-	File          []byte `json:"file"`
+	BlobID        string `json:"blob_id"`
 	Date          string `json:"date"`
 }
 
@@ -108,6 +198,7 @@ var ErrFollowDoesNotExist = errors.New("Follow does not exist")
 var ErrCommentDoesNotExist = errors.New("Comment does not exist")
 var ErrLikeDoesNotExist = errors.New("Like does not exist")
 var ErrMessageDoesNotExist = errors.New("Message does not exist")
+var ErrExportDoesNotExist = errors.New("export does not exist")
 
 // AppDatabase is the high level interface for the DB
 type AppDatabase interface {
@@ -116,27 +207,85 @@ type AppDatabase interface {
 	CheckUserById(User) (User, error)
 	GetUserId(string) (User, error)
 
-	CreateConversation(conversationId string, participants []string) (Conversation, error)
+	CreateConversation(participants []string) (Conversation, error)
 	GetConversations(string) ([]Conversation, error)
+	GetConversationList(User, string, int) ([]Conversation, string, error)
+	MarkConversationRead(uint64, string, int) error
 	GetConversation(string) (Conversation, error)
+	GetOrCreateDirectConversation(string, string) (Conversation, error)
 
-	UpdateGroupName(string, uint64, string) error
-	UpdateGroupPhoto(string, uint64, multipart.File) error
+	GetGroup(string) (Group, error)
+	GetGroupsOfUser(string) ([]Group, error)
+	UpdateGroupName(string, User, string) error
+	UpdateGroupDescription(string, User, string) error
+	UpdateGroupPhoto(string, User, string) error
+	UpdateGroupPermissions(string, GroupPermissions) error
 	CreateGroup(uint64, string,  string, []string) (string, error)
-	AddMemberToGroup(string, uint64, string) error
-	RemoveMemberFromGroup(string, string) error
+	AddMemberToGroup(string, User, string) error
+	SetGroupRole(string, string, string) error
+	CreateGroupInvite(GroupInvite) error
+	GetGroupInvites(string) ([]GroupInvite, error)
+	DeleteGroupInvite(string, string) error
+	JoinGroupWithInvite(string, User, time.Time) (string, bool, error)
+	GetJoinRequests(string) ([]JoinRequest, error)
+	ResolveJoinRequest(string, User, int64, bool) error
+	SetGroupAnnouncementOnly(string, User, bool) error
+	MuteGroupMember(string, string, User, *time.Time, time.Time) error
+	UnmuteGroupMember(string, string, User, time.Time) error
+	GetGroupMutes(string, time.Time) ([]GroupMute, error)
+	GetActiveMute(string, uint64, time.Time) (GroupMute, error)
+	RemoveMemberFromGroup(string, User, string) error
 
 	CommentMessage(string, string, string, uint64) error
-	UncommentMessage(string, string, uint64) error
-	DeleteMessage(string, string, uint64) error
-	SendMessage(string, Message) (Message, error)
-	ForwardMessage(string, string, string, uint64) (Message, error)
+	UncommentMessage(string, string, uint64, string) error
+	GetComments(string, string) ([]Comment, error)
+	GetMessages(string, uint64, int, int) ([]Message, error)
+	GetMessage(string, string) (Message, error)
+	ReplyToMessage(string, string, Message, bool) (Message, error)
+	GetThread(string, string, uint64, int, int) ([]Message, error)
+	GetMentions(User, int, int, bool) ([]Mention, error)
+	MarkMentionsRead(uint64, []int) error
+	PinMessage(string, string, User, int) error
+	UnpinMessage(string, string, User) error
+	GetPins(string, uint64) ([]Pin, error)
+	StarMessage(string, string, uint64) error
+	UnstarMessage(string, string, uint64) error
+	GetStarred(User, string, int64, int) ([]Starred, int64, error)
+	VotePoll(string, string, uint64, []int) (Poll, error)
+	RetractPollVote(string, string, uint64) (Poll, error)
+	DeleteMessage(string, string, uint64, bool) error
+	SendMessage(string, Message, bool, int64) (Message, error)
+	SetMessagePreview(string, int, MessagePreview) error
+	ForwardMessage(string, string, string, uint64, int64) (Message, error)
+	GetUserStorage(uint64) (int64, error)
 
-	GetUserPicture(string) ([]byte, error)
+	GetUserPicture(string) (string, error)
 	ChangeUserPhoto(User, Photo) error
 
+	CreateExport(Export) error
+	GetExport(string) (Export, error)
+	GetPendingExport(uint64) (Export, error)
+	ClaimNextExport() (Export, error)
+	UpdateExport(Export) error
+	ResetRunningExports() error
+	DeleteExportsBefore(time.Time) error
+	GetUserData(uint64) (UserData, error)
+
+	SetRetentionPolicy(string, *int) error
+	GetRetentionReport(int, time.Time) ([]RetentionReport, error)
+	PurgeExpiredMessages(int, time.Time, int) (int, error)
+
+	SetDisappearingTimer(string, User, string) error
+	GetDraft(uint64, string) (Draft, error)
+	SaveDraft(uint64, string, string, *int64) (Draft, error)
+	DeleteExpiredMessages(time.Time, int) (int, []string, error)
+
+	GetBlobReferences() (map[string]bool, error)
+	MigrateInlinePhotos(func(io.Reader) (string, error)) (int, error)
+
 	CreateUser(User) (User, error)
 	SetUsername(User, string) (User, error)
+	DeleteUser(uint64, bool) error
 
 	Ping() error
 }
@@ -158,7 +307,7 @@ func New(db *sql.DB) (AppDatabase, error) {
             CREATE TABLE IF NOT EXISTS users (
                 id       INTEGER PRIMARY KEY AUTOINCREMENT,
                 username TEXT    UNIQUE NOT NULL,
-                photo    BLOB
+                photo_id TEXT
             );
         `,
         "conversations": `
@@ -175,8 +324,78 @@ func New(db *sql.DB) (AppDatabase, error) {
                 message_content  TEXT    NOT NULL,
                 timestamp        DATETIME NOT NULL,
                 sender_id        INTEGER NOT NULL,
+                parent_id        INTEGER,  -- risposta nel thread di questo messaggio; NULL: messaggio della conversazione
                 FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id),
-                FOREIGN KEY(sender_id) REFERENCES users(id)
+                FOREIGN KEY(sender_id) REFERENCES users(id),
+                FOREIGN KEY(parent_id) REFERENCES messages(id)
+            );
+        `,
+        "mentions": `
+            CREATE TABLE IF NOT EXISTS mentions (
+                message_id      INTEGER NOT NULL,
+                user_id         INTEGER NOT NULL,
+                conversation_id TEXT    NOT NULL,
+                PRIMARY KEY(message_id, user_id),
+                FOREIGN KEY(message_id)      REFERENCES messages(id),
+                FOREIGN KEY(user_id)         REFERENCES users(id),
+                FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id)
+            );
+        `,
+        "pins": `
+            CREATE TABLE IF NOT EXISTS pins (
+                message_id      INTEGER  NOT NULL PRIMARY KEY,
+                conversation_id TEXT     NOT NULL,
+                pinned_by       INTEGER  NOT NULL,
+                pinned_at       DATETIME NOT NULL,
+                FOREIGN KEY(message_id)      REFERENCES messages(id),
+                FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id),
+                FOREIGN KEY(pinned_by)       REFERENCES users(id)
+            );
+        `,
+        "read_cursors": `
+            CREATE TABLE IF NOT EXISTS read_cursors (
+                user_id         INTEGER NOT NULL,
+                conversation_id TEXT    NOT NULL,
+                last_read_id    INTEGER NOT NULL,  -- i messaggi con ID maggiore non sono ancora stati letti
+                PRIMARY KEY(user_id, conversation_id),
+                FOREIGN KEY(user_id)         REFERENCES users(id),
+                FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id)
+            );
+        `,
+        "drafts": `
+            CREATE TABLE IF NOT EXISTS drafts (
+                user_id         INTEGER  NOT NULL,
+                conversation_id TEXT     NOT NULL,
+                text            TEXT     NOT NULL,  -- vuoto: la bozza è stata cancellata o il messaggio inviato
+                version         INTEGER  NOT NULL,
+                updated_at      DATETIME NOT NULL,
+                PRIMARY KEY(user_id, conversation_id),
+                FOREIGN KEY(user_id)         REFERENCES users(id),
+                FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id)
+            );
+        `,
+        "stars": `
+            CREATE TABLE IF NOT EXISTS stars (
+                id              INTEGER  PRIMARY KEY AUTOINCREMENT,  -- cursore della paginazione
+                user_id         INTEGER  NOT NULL,
+                message_id      INTEGER  NOT NULL,
+                conversation_id TEXT     NOT NULL,
+                starred_at      DATETIME NOT NULL,
+                UNIQUE(user_id, message_id),
+                FOREIGN KEY(user_id)         REFERENCES users(id),
+                FOREIGN KEY(message_id)      REFERENCES messages(id),
+                FOREIGN KEY(conversation_id) REFERENCES conversations(conversation_id)
+            );
+        `,
+        "poll_votes": `
+            CREATE TABLE IF NOT EXISTS poll_votes (
+                message_id INTEGER  NOT NULL,
+                user_id    INTEGER  NOT NULL,
+                option_id  INTEGER  NOT NULL,
+                voted_at   DATETIME NOT NULL,
+                PRIMARY KEY(message_id, user_id, option_id),
+                FOREIGN KEY(message_id) REFERENCES messages(id),
+                FOREIGN KEY(user_id)    REFERENCES users(id)
             );
         `,
         "comments": `
@@ -199,8 +418,82 @@ func New(db *sql.DB) (AppDatabase, error) {
                 group_name  TEXT    NOT NULL,
                 description TEXT,
                 members     TEXT    NOT NULL,  -- user1,user2,...
-                photo       BLOB,
-                FOREIGN KEY(admin_id) REFERENCES users(id)
+                photo_id    TEXT,
+                -- ruolo minimo per ogni azione: owner, admin o member
+                perm_rename          TEXT NOT NULL DEFAULT 'admin',
+                perm_change_photo    TEXT NOT NULL DEFAULT 'admin',
+                perm_add_members     TEXT NOT NULL DEFAULT 'admin',
+                perm_remove_members  TEXT NOT NULL DEFAULT 'admin',
+                perm_delete_messages TEXT NOT NULL DEFAULT 'admin',
+                announcement_only    INTEGER NOT NULL DEFAULT 0,  -- 1: scrivono solo owner e admin
+                FOREIGN KEY(admin_id) REFERENCES users(id)  -- chi ha creato il gruppo
+            );
+        `,
+        "group_roles": `
+            CREATE TABLE IF NOT EXISTS group_roles (
+                group_id   TEXT     NOT NULL,
+                user_id    INTEGER  NOT NULL,
+                role       TEXT     NOT NULL,  -- owner, admin (i semplici membri non hanno una riga)
+                granted_at DATETIME NOT NULL,
+                PRIMARY KEY(group_id, user_id),
+                FOREIGN KEY(group_id) REFERENCES groups(group_id),
+                FOREIGN KEY(user_id)  REFERENCES users(id)
+            );
+        `,
+        "group_mutes": `
+            CREATE TABLE IF NOT EXISTS group_mutes (
+                group_id   TEXT     NOT NULL,
+                user_id    INTEGER  NOT NULL,
+                muted_by   INTEGER  NOT NULL,
+                muted_at   DATETIME NOT NULL,
+                expires_at DATETIME,  -- NULL: finché non viene tolto
+                PRIMARY KEY(group_id, user_id),
+                FOREIGN KEY(group_id) REFERENCES groups(group_id),
+                FOREIGN KEY(user_id)  REFERENCES users(id)
+            );
+        `,
+        "group_invites": `
+            CREATE TABLE IF NOT EXISTS group_invites (
+                token             TEXT     NOT NULL PRIMARY KEY,
+                group_id          TEXT     NOT NULL,
+                created_by        INTEGER  NOT NULL,
+                created_at        DATETIME NOT NULL,
+                expires_at        DATETIME,            -- NULL: non scade
+                max_uses          INTEGER  NOT NULL,   -- 0: nessun limite
+                uses              INTEGER  NOT NULL,
+                requires_approval INTEGER  NOT NULL,
+                FOREIGN KEY(group_id)   REFERENCES groups(group_id),
+                FOREIGN KEY(created_by) REFERENCES users(id)
+            );
+        `,
+        "group_join_requests": `
+            CREATE TABLE IF NOT EXISTS group_join_requests (
+                id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+                group_id     TEXT     NOT NULL,
+                user_id      INTEGER  NOT NULL,
+                invite_token TEXT     NOT NULL,
+                requested_at DATETIME NOT NULL,
+                UNIQUE(group_id, user_id),
+                FOREIGN KEY(group_id) REFERENCES groups(group_id),
+                FOREIGN KEY(user_id)  REFERENCES users(id)
+            );
+        `,
+        "retention_policies": `
+            CREATE TABLE IF NOT EXISTS retention_policies (
+                conversation_id TEXT    NOT NULL PRIMARY KEY,
+                days            INTEGER NOT NULL  -- 0: i messaggi non scadono
+            );
+        `,
+        "exports": `
+            CREATE TABLE IF NOT EXISTS exports (
+                export_id    TEXT     NOT NULL PRIMARY KEY,
+                user_id      INTEGER  NOT NULL,
+                status       TEXT     NOT NULL,  -- pending, running, completed, failed
+                created_at   DATETIME NOT NULL,
+                completed_at DATETIME,
+                blob_id      TEXT,
+                error        TEXT,
+                FOREIGN KEY(user_id) REFERENCES users(id)
             );
         `,
     }
@@ -212,10 +505,85 @@ func New(db *sql.DB) (AppDatabase, error) {
         }
     }
 
+    // colonne aggiunte dopo la prima versione dello schema: le tabelle già esistenti vengono aggiornate qui
+    columns := []struct{ table, column, decl string }{
+        {"users", "photo_id", "TEXT"},
+        {"groups", "photo_id", "TEXT"},
+        {"groups", "perm_rename", "TEXT NOT NULL DEFAULT 'admin'"},
+        {"groups", "perm_change_photo", "TEXT NOT NULL DEFAULT 'admin'"},
+        {"groups", "perm_add_members", "TEXT NOT NULL DEFAULT 'admin'"},
+        {"groups", "perm_remove_members", "TEXT NOT NULL DEFAULT 'admin'"},
+        {"groups", "perm_delete_messages", "TEXT NOT NULL DEFAULT 'admin'"},
+        {"groups", "announcement_only", "INTEGER NOT NULL DEFAULT 0"},
+        {"messages", "parent_id", "INTEGER"},
+        {"mentions", "read_at", "DATETIME"},
+        {"messages", "preview", "TEXT"},
+        {"messages", "blob_id", "TEXT"},
+        {"messages", "blob_size", "INTEGER"},
+        {"conversations", "disappearing_timer", "TEXT NOT NULL DEFAULT 'off'"},
+        {"messages", "expires_at", "DATETIME"},
+        {"conversations", "last_activity", "DATETIME"},
+        {"conversations", "last_sender_id", "INTEGER"},
+        {"conversations", "last_expires_at", "DATETIME"},
+    }
+    for _, col := range columns {
+        if err := addColumnIfMissing(db, col.table, col.column, col.decl); err != nil {
+            return nil, fmt.Errorf("error adding column %q to table %q: %w", col.column, col.table, err)
+        }
+    }
+
+    // indici, creati dopo le colonne perché possono usarne di appena aggiunte
+    indexes := []string{
+        `CREATE INDEX IF NOT EXISTS messages_parent ON messages (parent_id)`,
+        `CREATE INDEX IF NOT EXISTS mentions_user ON mentions (user_id)`,
+        `CREATE INDEX IF NOT EXISTS messages_sender_blob ON messages (sender_id, blob_id) WHERE blob_id IS NOT NULL`,
+        `CREATE INDEX IF NOT EXISTS messages_expires_at ON messages (expires_at) WHERE expires_at IS NOT NULL`,
+        `CREATE INDEX IF NOT EXISTS messages_conversation ON messages (conversation_id, id)`,
+        `CREATE INDEX IF NOT EXISTS conversations_last_expires_at ON conversations (last_expires_at) WHERE last_expires_at IS NOT NULL`,
+    }
+    for _, stmt := range indexes {
+        if _, err := db.Exec(stmt); err != nil {
+            return nil, fmt.Errorf("error creating index: %w", err)
+        }
+    }
+
+    // i gruppi creati prima delle chat di gruppo non hanno una conversazione
+    if err := migrateGroupConversations(db); err != nil {
+        return nil, fmt.Errorf("error creating group conversations: %w", err)
+    }
+
+    // le versioni precedenti permettevano di ripetere la stessa reaction
+    if err := migrateUniqueComments(db); err != nil {
+        return nil, fmt.Errorf("error deduplicating reactions: %w", err)
+    }
+
+    // i gruppi creati prima dei ruoli avevano solo admin_id
+    if err := migrateGroupOwners(db); err != nil {
+        return nil, fmt.Errorf("error assigning group owners: %w", err)
+    }
+
+    // le versioni precedenti non aggiornavano l'ultimo messaggio delle conversazioni
+    if err := migrateLastActivity(db); err != nil {
+        return nil, fmt.Errorf("error computing the last activity of conversations: %w", err)
+    }
+
     // alla fine, restituisci l’istanza pronta
     return &appdbimpl{c: db}, nil
 }
 
+// addColumnIfMissing aggiunge la colonna `column` alla tabella `table` se non esiste ancora.
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
 func (db *appdbimpl) Ping() error {
 	return db.c.Ping()
 }
\ No newline at end of file
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// Timer dei messaggi effimeri di una conversazione: dopo quanto tempo dall'invio i nuovi messaggi spariscono
+const (
+	DisappearingOff  = "off"
+	DisappearingHour = "1h"
+	DisappearingDay  = "1d"
+	DisappearingWeek = "7d"
+)
+
+// disappearingDurations sono le durate dei timer attivi
+var disappearingDurations = map[string]time.Duration{
+	DisappearingHour: time.Hour,
+	DisappearingDay:  24 * time.Hour,
+	DisappearingWeek: 7 * 24 * time.Hour,
+}
+
+// ValidDisappearingTimer dice se `timer` è uno dei timer dei messaggi effimeri.
+func ValidDisappearingTimer(timer string) bool {
+	_, ok := disappearingDurations[timer]
+	return ok || timer == DisappearingOff
+}
+
+// notExpired esclude i messaggi effimeri già scaduti che lo sweeper non ha ancora cancellato. Parametro: l'ora
+// attuale.
+const notExpired = `(messages.expires_at IS NULL OR julianday(messages.expires_at) > julianday(?))`
+
+// messageExpiry ritorna la scadenza di un messaggio inviato all'istante `sent` nella conversazione, secondo il suo
+// timer dei messaggi effimeri: NULL se il timer è spento.
+func messageExpiry(tx *sql.Tx, conversationId string, sent time.Time) (sql.NullTime, error) {
+	var timer string
+	err := tx.QueryRow(`SELECT disappearing_timer FROM conversations WHERE conversation_id = ?`, conversationId).Scan(&timer)
+	if err == sql.ErrNoRows {
+		return sql.NullTime{}, ErrConversationDoesNotExist
+	} else if err != nil {
+		return sql.NullTime{}, err
+	}
+	d, ok := disappearingDurations[timer]
+	if !ok {
+		return sql.NullTime{}, nil
+	}
+	return sql.NullTime{Time: sent.Add(d), Valid: true}, nil
+}
+
+// SetDisappearingTimer imposta il timer dei messaggi effimeri della conversazione. Vale solo per i messaggi inviati
+// da quel momento; il cambio compare nella conversazione come messaggio di sistema, che non scade. Se il timer non
+// cambia non succede nulla.
+func (db *appdbimpl) SetDisappearingTimer(conversationId string, actor User, timer string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var old string
+	err = tx.QueryRow(`SELECT disappearing_timer FROM conversations WHERE conversation_id = ?`, conversationId).Scan(&old)
+	if err == sql.ErrNoRows {
+		return ErrConversationDoesNotExist
+	} else if err != nil {
+		return err
+	}
+	if old == timer {
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPDATE conversations SET disappearing_timer = ? WHERE conversation_id = ?`, timer, conversationId); err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, conversationId, actor, SystemEvent{Event: EventDisappearingChanged, Old: old, New: timer}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteExpiredMessages cancella al più `limit` messaggi effimeri scaduti all'istante `now`, con tutto ciò che li
+// riguarda, e aggiorna last_message delle conversazioni coinvolte. Ritorna il numero di messaggi cancellati e gli ID
+// dei blob dei loro file, che potrebbero non servire più.
+func (db *appdbimpl) DeleteExpiredMessages(now time.Time, limit int) (int, []string, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`
+		SELECT id, conversation_id
+		  FROM messages
+		 WHERE expires_at IS NOT NULL AND julianday(expires_at) <= julianday(?)
+		 ORDER BY expires_at
+		 LIMIT ?`,
+		now, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	var ids []int
+	conversations := make(map[string]bool)
+	for rows.Next() {
+		var id int
+		var conversationId string
+		if err := rows.Scan(&id, &conversationId); err != nil {
+			_ = rows.Close()
+			return 0, nil, err
+		}
+		ids = append(ids, id)
+		conversations[conversationId] = true
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, nil
+	}
+
+	// i file dei messaggi e delle risposte nei loro thread, che deleteMessageRows cancella insieme
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	blobRows, err := tx.Query(`
+		WITH RECURSIVE doomed(id) AS (
+			SELECT id FROM messages WHERE id IN (`+strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")+`)
+			UNION
+			SELECT m.id FROM messages m JOIN doomed d ON m.parent_id = d.id
+		)
+		SELECT DISTINCT blob_id FROM messages WHERE blob_id IS NOT NULL AND id IN (SELECT id FROM doomed)`,
+		args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	var blobs []string
+	for blobRows.Next() {
+		var blobID string
+		if err := blobRows.Scan(&blobID); err != nil {
+			_ = blobRows.Close()
+			return 0, nil, err
+		}
+		blobs = append(blobs, blobID)
+	}
+	_ = blobRows.Close()
+	if err := blobRows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	if err := deleteMessageRows(tx, ids); err != nil {
+		return 0, nil, err
+	}
+	for conversationId := range conversations {
+		if err := refreshLastMessage(tx, conversationId); err != nil {
+			return 0, nil, err
+		}
+	}
+	return len(ids), blobs, tx.Commit()
+}
+
+// expiryNow è l'ora con cui le letture nascondono i messaggi scaduti (parametro di notExpired)
+func expiryNow() time.Time {
+	return globaltime.Now()
+}
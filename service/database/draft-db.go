@@ -0,0 +1,117 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+var ErrDraftConflict = errors.New("draft changed since the given version")
+
+// Draft è la bozza del messaggio che l'utente sta scrivendo in una conversazione, salvata sul server così la ritrova
+// da qualsiasi client. Una bozza vuota equivale a nessuna bozza. Version aumenta a ogni modifica, anche quando la
+// bozza viene svuotata, così un client può accorgersi che è stata cambiata da un altro.
+type Draft struct {
+	ConversationID string     `json:"conversation_id"`
+	Text           string     `json:"text"`
+	Version        int64      `json:"version"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// draftQuery legge la bozza di un utente in una conversazione. Parametri: ID dell'utente, ID della conversazione.
+const draftQuery = `SELECT text, version, updated_at FROM drafts WHERE user_id = ? AND conversation_id = ?`
+
+// scanDraft legge il risultato di draftQuery; se la bozza non c'è ritorna una bozza vuota con versione 0.
+func scanDraft(row rowScanner, conversationId string) (Draft, error) {
+	d := Draft{ConversationID: conversationId}
+	var updatedAt time.Time
+	err := row.Scan(&d.Text, &d.Version, &updatedAt)
+	if err == sql.ErrNoRows {
+		return d, nil
+	} else if err != nil {
+		return d, err
+	}
+	d.UpdatedAt = &updatedAt
+	return d, nil
+}
+
+// GetDraft ritorna la bozza dell'utente nella conversazione.
+func (db *appdbimpl) GetDraft(userID uint64, conversationId string) (Draft, error) {
+	return scanDraft(db.c.QueryRow(draftQuery, userID, conversationId), conversationId)
+}
+
+// SaveDraft sostituisce la bozza dell'utente nella conversazione con `text` (vince l'ultima scrittura); con text vuoto
+// la bozza viene cancellata. Se baseVersion non è nil deve essere la versione attuale della bozza, altrimenti la bozza
+// non cambia e viene ritornata insieme a ErrDraftConflict. Il controllo della versione è nella scrittura stessa, così due
+// salvataggi contemporanei con la stessa versione non possono riuscire entrambi.
+func (db *appdbimpl) SaveDraft(userID uint64, conversationId string, text string, baseVersion *int64) (Draft, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Draft{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := globaltime.Now()
+	var res sql.Result
+	switch {
+	case baseVersion == nil && text == "":
+		res, err = tx.Exec(
+			`UPDATE drafts SET text = '', version = version + 1, updated_at = ?
+			  WHERE user_id = ? AND conversation_id = ? AND text <> ''`,
+			now, userID, conversationId)
+	case baseVersion == nil:
+		res, err = tx.Exec(
+			`INSERT INTO drafts (user_id, conversation_id, text, version, updated_at) VALUES (?, ?, ?, 1, ?)
+			 ON CONFLICT(user_id, conversation_id) DO UPDATE
+			 SET text = excluded.text, version = version + 1, updated_at = excluded.updated_at`,
+			userID, conversationId, text, now)
+	case *baseVersion == 0 && text != "":
+		// versione 0: l'utente non ha mai avuto una bozza in questa conversazione
+		res, err = tx.Exec(
+			`INSERT INTO drafts (user_id, conversation_id, text, version, updated_at) VALUES (?, ?, ?, 1, ?)
+			 ON CONFLICT(user_id, conversation_id) DO NOTHING`,
+			userID, conversationId, text, now)
+	case *baseVersion > 0:
+		// svuotare una bozza già vuota non è una modifica
+		res, err = tx.Exec(
+			`UPDATE drafts SET text = ?, version = version + 1, updated_at = ?
+			  WHERE user_id = ? AND conversation_id = ? AND version = ? AND (text <> '' OR ? <> '')`,
+			text, now, userID, conversationId, *baseVersion, text)
+	}
+	if err != nil {
+		return Draft{}, err
+	}
+	written := false
+	if res != nil {
+		n, err := res.RowsAffected()
+		if err != nil {
+			return Draft{}, err
+		}
+		written = n > 0
+	}
+
+	current, err := scanDraft(tx.QueryRow(draftQuery, userID, conversationId), conversationId)
+	if err != nil {
+		return current, err
+	}
+	if err := tx.Commit(); err != nil {
+		return current, err
+	}
+	// se non è stato scritto niente, va bene solo se si voleva svuotare una bozza vuota della versione indicata
+	if !written && baseVersion != nil && (text != "" || current.Text != "" || current.Version != *baseVersion) {
+		return current, ErrDraftConflict
+	}
+	return current, nil
+}
+
+// clearDraft svuota la bozza dell'utente nella conversazione, se ne ha una, dentro la transazione `tx`. Viene
+// chiamata quando l'utente invia un messaggio nella conversazione.
+func clearDraft(tx *sql.Tx, conversationId string, userID uint64) error {
+	_, err := tx.Exec(
+		`UPDATE drafts SET text = '', version = version + 1, updated_at = ?
+		  WHERE user_id = ? AND conversation_id = ? AND text <> ''`,
+		globaltime.Now(), userID, conversationId)
+	return err
+}
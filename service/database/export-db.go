@@ -0,0 +1,210 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Stati di un export
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+)
+
+// Export è la richiesta di un utente di scaricare i propri dati. L'archivio, una volta generato, è nel blob store.
+type Export struct {
+	ExportID    string     `json:"export_id"`
+	UserID      uint64     `json:"user_id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	BlobID      string     `json:"-"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// UserData contiene tutto quello che il server conserva su un utente.
+type UserData struct {
+	Profile       UserProfile    `json:"profile"`
+	Conversations []Conversation `json:"conversations"`
+	Messages      []Message      `json:"messages"`
+	Reactions     []UserReaction `json:"reactions"`
+	Groups        []Group        `json:"groups"`
+}
+
+// UserProfile è il profilo di un utente, con il riferimento alla sua foto.
+type UserProfile struct {
+	ID       uint64 `json:"id"`
+	Username string `json:"username"`
+	PhotoID  string `json:"photo_id,omitempty"`
+}
+
+// UserReaction è una emoji reaction lasciata da un utente su un messaggio.
+type UserReaction struct {
+	ConversationID string    `json:"conversation_id"`
+	MessageID      int       `json:"message_id"`
+	Emoji          string    `json:"emoji"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+const exportColumns = `export_id, user_id, status, created_at, completed_at, COALESCE(blob_id, ''), COALESCE(error, '')`
+
+func scanExport(row rowScanner) (Export, error) {
+	var e Export
+	var completedAt sql.NullTime
+	if err := row.Scan(&e.ExportID, &e.UserID, &e.Status, &e.CreatedAt, &completedAt, &e.BlobID, &e.Error); err != nil {
+		if err == sql.ErrNoRows {
+			return e, ErrExportDoesNotExist
+		}
+		return e, err
+	}
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	return e, nil
+}
+
+func (db *appdbimpl) CreateExport(e Export) error {
+	_, err := db.c.Exec(
+		`INSERT INTO exports (export_id, user_id, status, created_at) VALUES (?, ?, ?, ?)`,
+		e.ExportID, e.UserID, e.Status, e.CreatedAt)
+	return err
+}
+
+func (db *appdbimpl) GetExport(exportID string) (Export, error) {
+	return scanExport(db.c.QueryRow(`SELECT `+exportColumns+` FROM exports WHERE export_id = ?`, exportID))
+}
+
+// GetPendingExport ritorna l'export dell'utente non ancora completato, se esiste.
+func (db *appdbimpl) GetPendingExport(userID uint64) (Export, error) {
+	return scanExport(db.c.QueryRow(
+		`SELECT `+exportColumns+` FROM exports WHERE user_id = ? AND status IN (?, ?) ORDER BY created_at LIMIT 1`,
+		userID, ExportPending, ExportRunning))
+}
+
+// ClaimNextExport prende l'export in attesa più vecchio e lo segna come in esecuzione. Ritorna ErrExportDoesNotExist
+// se non ci sono export in attesa.
+func (db *appdbimpl) ClaimNextExport() (Export, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Export{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	e, err := scanExport(tx.QueryRow(
+		`SELECT `+exportColumns+` FROM exports WHERE status = ? ORDER BY created_at LIMIT 1`, ExportPending))
+	if err != nil {
+		return e, err
+	}
+	if _, err := tx.Exec(`UPDATE exports SET status = ? WHERE export_id = ?`, ExportRunning, e.ExportID); err != nil {
+		return e, err
+	}
+	e.Status = ExportRunning
+	return e, tx.Commit()
+}
+
+func (db *appdbimpl) UpdateExport(e Export) error {
+	res, err := db.c.Exec(
+		`UPDATE exports SET status = ?, completed_at = ?, blob_id = NULLIF(?, ''), error = NULLIF(?, '') WHERE export_id = ?`,
+		e.Status, e.CompletedAt, e.BlobID, e.Error, e.ExportID)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrExportDoesNotExist
+	}
+	return nil
+}
+
+// ResetRunningExports rimette in attesa gli export interrotti da un riavvio del server.
+func (db *appdbimpl) ResetRunningExports() error {
+	_, err := db.c.Exec(`UPDATE exports SET status = ? WHERE status = ?`, ExportPending, ExportRunning)
+	return err
+}
+
+// DeleteExportsBefore cancella gli export terminati prima di `before`. Gli archivi diventano così non referenziati
+// e vengono rimossi dal garbage collector dei blob.
+func (db *appdbimpl) DeleteExportsBefore(before time.Time) error {
+	_, err := db.c.Exec(
+		`DELETE FROM exports WHERE status IN (?, ?) AND julianday(completed_at) < julianday(?)`,
+		ExportCompleted, ExportFailed, before)
+	return err
+}
+
+// GetUserData raccoglie i dati dell'utente per l'export: profilo, conversazioni a cui partecipa, messaggi inviati,
+// reaction lasciate e gruppi che amministra.
+func (db *appdbimpl) GetUserData(userID uint64) (UserData, error) {
+	var data UserData
+	var photoID sql.NullString
+	err := db.c.QueryRow(`SELECT id, username, photo_id FROM users WHERE id = ?`, userID).
+		Scan(&data.Profile.ID, &data.Profile.Username, &photoID)
+	if err == sql.ErrNoRows {
+		return data, ErrUserDoesNotExist
+	} else if err != nil {
+		return data, err
+	}
+	data.Profile.PhotoID = photoID.String
+
+	data.Conversations, err = db.GetConversations(data.Profile.Username)
+	if err != nil {
+		return data, err
+	}
+
+	// Messaggi inviati dall'utente
+	rows, err := db.c.Query(`SELECT `+messageColumns+` FROM messages WHERE sender_id = ? AND `+notExpired+` ORDER BY id`,
+		userID, expiryNow())
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			_ = rows.Close()
+			return data, err
+		}
+		data.Messages = append(data.Messages, m)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	// Reaction lasciate dall'utente
+	rows, err = db.c.Query(
+		`SELECT conversation_id, message_id, emoji, timestamp FROM comments WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return data, err
+	}
+	for rows.Next() {
+		var r UserReaction
+		if err := rows.Scan(&r.ConversationID, &r.MessageID, &r.Emoji, &r.Timestamp); err != nil {
+			_ = rows.Close()
+			return data, err
+		}
+		data.Reactions = append(data.Reactions, r)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return data, err
+	}
+
+	// Gruppi amministrati dall'utente, come owner o come admin
+	rows, err = db.c.Query(`SELECT `+groupColumns+` FROM `+groupFrom+` WHERE g.group_id IN (SELECT group_id FROM group_roles WHERE user_id = ? AND role IN (?, ?))
+		  ORDER BY g.group_id`, userID, RoleOwner, RoleAdmin)
+	if err != nil {
+		return data, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return data, err
+		}
+		data.Groups = append(data.Groups, g)
+	}
+	return data, rows.Err()
+}
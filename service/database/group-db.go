@@ -4,66 +4,67 @@ import (
 	"fmt"
 	"database/sql"
 	"strings"
-	"mime/multipart"
-	"io"
-	"log"
 	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
 )
 
 var (
-	ErrGroupNotFound   = fmt.Errorf("group not found")
-	ErrGroupNotUpdated = fmt.Errorf("group not updated")
+	ErrGroupNotFound       = fmt.Errorf("group not found")
+	ErrMemberAlreadyExists = fmt.Errorf("member already exists")
+	ErrMemberNotFound      = fmt.Errorf("member not found in group")
+	ErrLastOwner           = fmt.Errorf("the group must have at least one owner")
 )
 
-// UpdateGroupName aggiorna il nome di un gruppo se l'utente è admin.
-func (db *appdbimpl) UpdateGroupName(groupId string, adminID uint64, groupName string) error {
-	res, err := db.c.Exec(`UPDATE groups SET group_name = ? WHERE group_id = ? AND admin_id = ?`, groupName, groupId, adminID)
-	if err != nil {
-		return err
-	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return err
-	} else if affected == 0 {
-		return ErrGroupNotUpdated
-	}
-	return nil
+// UpdateGroupName aggiorna il nome di un gruppo. Chi può farlo lo decide GroupPermissions.Rename, controllato dal
+// chiamante.
+func (db *appdbimpl) UpdateGroupName(groupId string, actor User, groupName string) error {
+	return db.updateGroupField(groupId, actor, "group_name", groupName, EventGroupRenamed)
 }
 
-func (db *appdbimpl) UpdateGroupPhoto(groupId string, adminID uint64, photoData multipart.File) error {
-    defer photoData.Close()
+// UpdateGroupDescription aggiorna la descrizione di un gruppo.
+func (db *appdbimpl) UpdateGroupDescription(groupId string, actor User, description string) error {
+	return db.updateGroupField(groupId, actor, "description", description, EventDescriptionChanged)
+}
 
-    // 1) Leggi i byte del file
-    photoBytes, err := io.ReadAll(photoData)
-    if err != nil {
-        return err
-    }
+// UpdateGroupPhoto salva il riferimento al blob con la nuova foto del gruppo.
+func (db *appdbimpl) UpdateGroupPhoto(groupId string, actor User, photoID string) error {
+	return db.updateGroupField(groupId, actor, "photo_id", photoID, EventPhotoChanged)
+}
 
-    // 2) Esegui l'UPDATE SOLO su group_id
-    res, err := db.c.Exec(
-        `UPDATE groups
-            SET photo = ?
-          WHERE group_id = ?`,
-        photoBytes,
-        groupId,
-    )
-    if err != nil {
-        return err
-    }
+// updateGroupField imposta la colonna `column` (mai scelta dal client) del gruppo `groupId` e annuncia il cambio nella
+// conversazione con un messaggio di sistema `event`, con il vecchio e il nuovo valore. Se il valore non cambia non
+// succede nulla.
+func (db *appdbimpl) updateGroupField(groupId string, actor User, column string, value string, event string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
 
-    // 3) Controlla quante righe sono state modificate
-    affected, err := res.RowsAffected()
-	log.Printf("Trying to update group %s with admin ID %d", groupId, adminID)
-	log.Printf("Rows affected: %d", affected)
-    if affected == 0 {
-        return ErrGroupNotUpdated
-    }
+	var old string
+	err = tx.QueryRow(`SELECT COALESCE(`+column+`, '') FROM groups WHERE group_id = ?`, groupId).Scan(&old)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	} else if err != nil {
+		return err
+	}
+	if old == value {
+		return nil
+	}
 
-    return nil
+	if _, err := tx.Exec(`UPDATE groups SET `+column+` = ? WHERE group_id = ?`, value, groupId); err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, groupId, actor, SystemEvent{Event: event, Old: old, New: value}); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
+// CreateGroup crea un gruppo con la sua conversazione; `creatorID` ne diventa l'owner.
 func (db *appdbimpl) CreateGroup(
-    adminID uint64,
+    creatorID uint64,
     groupName string,
     description string,
     members []string,
@@ -75,12 +76,23 @@ func (db *appdbimpl) CreateGroup(
     // 2) Prepara la stringa dei membri
     membersStr := strings.Join(members, ",")
 
-    // 3) Esegui l'INSERT con tutti e 5 i placeholder
-    _, err := db.c.Exec(
+    // 3) Il gruppo, il suo owner e la sua conversazione (con lo stesso ID) vengono creati insieme
+    tx, err := db.c.Begin()
+    if err != nil {
+        return "", err
+    }
+    defer func() { _ = tx.Rollback() }()
+
+    // i membri devono esistere già: un nome non registrato verrebbe ereditato da chi lo registra dopo
+    if err := checkUsersExist(tx, members); err != nil {
+        return "", err
+    }
+
+    _, err = tx.Exec(
         `INSERT INTO groups (group_id, admin_id, group_name, description, members)
          VALUES (?, ?, ?, ?, ?)`,
         groupID,
-        adminID,
+        creatorID,
         groupName,
         description,
         membersStr,
@@ -88,78 +100,311 @@ func (db *appdbimpl) CreateGroup(
     if err != nil {
         return "", err
     }
+    if err := setGroupRoleTx(tx, groupID, creatorID, RoleOwner); err != nil {
+        return "", err
+    }
+    if err := syncGroupConversation(tx, groupID, members); err != nil {
+        return "", err
+    }
+    if err := tx.Commit(); err != nil {
+        return "", err
+    }
 
     // 4) Ritorna il nuovo groupID
     return groupID, nil
 }
 
-// AddMemberToGroup aggiunge un nuovo membro a un gruppo esistente.
-// Si recupera la lista attuale, si aggiunge il nuovo membro e si aggiorna il record.
-func (db *appdbimpl) AddMemberToGroup(groupId string, adminID uint64, newMemberUsername string) error {
-	var membersStr string
-	err := db.c.QueryRow(`SELECT members FROM groups WHERE group_id = ? AND admin_id = ?`, groupId, adminID).Scan(&membersStr)
+// AddMemberToGroup aggiunge un nuovo membro a un gruppo esistente, con il ruolo di semplice membro.
+// Si recupera la lista attuale, si aggiunge il nuovo membro e si aggiorna il record, insieme ai partecipanti della
+// conversazione del gruppo.
+func (db *appdbimpl) AddMemberToGroup(groupId string, actor User, newMemberUsername string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := addGroupMember(tx, groupId, newMemberUsername); err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, groupId, actor, SystemEvent{Event: EventMemberAdded, Subject: newMemberUsername}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addGroupMember aggiunge `username` in fondo ai membri del gruppo e ai partecipanti della sua conversazione. Se
+// l'utente non esiste ritorna ErrUserDoesNotExist.
+func addGroupMember(tx *sql.Tx, groupId string, username string) error {
+	members, err := groupMembersTx(tx, groupId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrGroupNotFound
-		}
 		return err
 	}
-	members := strings.Split(membersStr, ",")
 	// Verifica che il nuovo membro non esista già.
-	for _, m := range members {
-		if m == newMemberUsername {
-			return fmt.Errorf("member already exists")
-		}
+	if containsString(members, username) {
+		return ErrMemberAlreadyExists
+	}
+	if err := checkUsersExist(tx, []string{username}); err != nil {
+		return err
+	}
+	members = append(members, username)
+	if _, err := tx.Exec(`UPDATE groups SET members = ? WHERE group_id = ?`, strings.Join(members, ","), groupId); err != nil {
+		return err
 	}
-	members = append(members, newMemberUsername)
-	updatedMembersStr := strings.Join(members, ",")
-	res, err := db.c.Exec(`UPDATE groups SET members = ? WHERE group_id = ? AND admin_id = ?`, updatedMembersStr, groupId, adminID)
+	return syncGroupConversation(tx, groupId, members)
+}
+
+// RemoveMemberFromGroup rimuove un membro da un gruppo, sia che esca da solo (actor è il membro) sia che venga
+// rimosso da un admin. Vedi removeGroupMember.
+func (db *appdbimpl) RemoveMemberFromGroup(groupId string, actor User, memberUsername string) error {
+	tx, err := db.c.Begin()
 	if err != nil {
 		return err
 	}
-	affected, err := res.RowsAffected()
+	defer func() { _ = tx.Rollback() }()
+
+	exists, err := removeGroupMember(tx, groupId, memberUsername)
 	if err != nil {
 		return err
-	} else if affected == 0 {
-		return ErrGroupNotUpdated
 	}
-	return nil
+	if exists {
+		event := SystemEvent{Event: EventMemberRemoved, Subject: memberUsername}
+		if memberUsername == actor.CurrentUsername {
+			event.Event = EventMemberLeft
+		}
+		if err := insertSystemMessage(tx, groupId, actor, event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-// RemoveMemberFromGroup rimuove un membro da un gruppo.
-// La funzione aggiorna la lista dei membri rimuovendo il membro specificato.
-func (db *appdbimpl) RemoveMemberFromGroup(groupId string, memberUsername string) error {
-	var membersStr string
-	err := db.c.QueryRow(`SELECT members FROM groups WHERE group_id = ?`, groupId).Scan(&membersStr)
+// removeGroupMember toglie `memberUsername` dai membri del gruppo, dal suo ruolo e dalla conversazione del gruppo.
+// Se era l'ultimo owner, il ruolo passa a un altro membro (vedi ensureGroupOwner); se era l'ultimo membro, il gruppo
+// viene cancellato con la sua conversazione e il risultato è false.
+func removeGroupMember(tx *sql.Tx, groupId string, memberUsername string) (bool, error) {
+	members, err := groupMembersTx(tx, groupId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return ErrGroupNotFound
-		}
-		return err
+		return false, err
 	}
-	members := strings.Split(membersStr, ",")
 	var updatedMembers []string
-	found := false
 	for _, m := range members {
-		if m == memberUsername {
-			found = true
-			continue
+		if m != memberUsername {
+			updatedMembers = append(updatedMembers, m)
 		}
-		updatedMembers = append(updatedMembers, m)
 	}
-	if !found {
-		return fmt.Errorf("member not found in group")
+	if len(updatedMembers) == len(members) {
+		return true, ErrMemberNotFound
+	}
+	if len(updatedMembers) == 0 {
+		return false, deleteGroup(tx, groupId)
+	}
+
+	if _, err := tx.Exec(`UPDATE groups SET members = ? WHERE group_id = ?`, strings.Join(updatedMembers, ","), groupId); err != nil {
+		return true, err
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM group_roles WHERE group_id = ? AND user_id IN (SELECT id FROM users WHERE username = ?)`,
+		groupId, memberUsername); err != nil {
+		return true, err
+	}
+	if err := ensureGroupOwner(tx, groupId, updatedMembers); err != nil {
+		return true, err
 	}
-	updatedMembersStr := strings.Join(updatedMembers, ",")
-	res, err := db.c.Exec(`UPDATE groups SET members = ? WHERE group_id = ?`, updatedMembersStr, groupId)
+	return true, syncGroupConversation(tx, groupId, updatedMembers)
+}
+
+// deleteGroup cancella il gruppo, i ruoli, gli inviti, i mute e la sua conversazione con tutti i messaggi.
+func deleteGroup(tx *sql.Tx, groupId string) error {
+	ids, err := queryIDs(tx, `SELECT id FROM messages WHERE conversation_id = ?`, groupId)
 	if err != nil {
 		return err
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
+	if err := deleteMessageRows(tx, ids); err != nil {
 		return err
-	} else if affected == 0 {
-		return ErrGroupNotUpdated
+	}
+	for _, stmt := range []string{
+		`DELETE FROM conversations WHERE conversation_id = ?`,
+		`DELETE FROM drafts WHERE conversation_id = ?`,
+		`DELETE FROM read_cursors WHERE conversation_id = ?`,
+		`DELETE FROM retention_policies WHERE conversation_id = ?`,
+		`DELETE FROM group_roles WHERE group_id = ?`,
+		`DELETE FROM group_invites WHERE group_id = ?`,
+		`DELETE FROM group_mutes WHERE group_id = ?`,
+		`DELETE FROM group_join_requests WHERE group_id = ?`,
+		`DELETE FROM groups WHERE group_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, groupId); err != nil {
+			return err
+		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// groupMembersTx ritorna gli username dei membri del gruppo, in ordine di ingresso.
+func groupMembersTx(tx *sql.Tx, groupId string) ([]string, error) {
+	var membersStr string
+	err := tx.QueryRow(`SELECT members FROM groups WHERE group_id = ?`, groupId).Scan(&membersStr)
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var members []string
+	for _, m := range strings.Split(membersStr, ",") {
+		if m != "" {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// syncGroupConversation allinea i partecipanti della conversazione del gruppo (che ha lo stesso ID del gruppo) ai
+// membri, creando la conversazione se non esiste ancora.
+func syncGroupConversation(tx *sql.Tx, groupId string, members []string) error {
+	_, err := tx.Exec(
+		`INSERT INTO conversations (conversation_id, participants, last_message, last_activity) VALUES (?, ?, NULL, ?)
+		 ON CONFLICT(conversation_id) DO UPDATE SET participants = excluded.participants`,
+		groupId, strings.Join(members, ","), globaltime.Now())
+	return err
+}
+
+// migrateGroupConversations crea la conversazione dei gruppi creati prima che i gruppi avessero una chat. I membri
+// salvati per ID (invece che per username) vengono convertiti in username.
+func migrateGroupConversations(c *sql.DB) error {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	type groupRow struct {
+		id      string
+		members []string
+	}
+	var groups []groupRow
+	rows, err := tx.Query(
+		`SELECT group_id, members FROM groups
+		  WHERE group_id NOT IN (SELECT conversation_id FROM conversations)`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var g groupRow
+		var membersStr string
+		if err := rows.Scan(&g.id, &membersStr); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		g.members = strings.Split(membersStr, ",")
+		groups = append(groups, g)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		var members []string
+		for _, m := range g.members {
+			var username string
+			err := tx.QueryRow(
+				`SELECT username FROM users WHERE username = ?
+				 UNION ALL
+				 SELECT username FROM users WHERE CAST(id AS TEXT) = ?
+				 LIMIT 1`, m, m).Scan(&username)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if !containsString(members, username) {
+				members = append(members, username)
+			}
+		}
+		if _, err := tx.Exec(`UPDATE groups SET members = ? WHERE group_id = ?`, strings.Join(members, ","), g.id); err != nil {
+			return err
+		}
+		if err := syncGroupConversation(tx, g.id, members); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// containsString indica se `list` contiene `s`.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// groupColumns sono le colonne lette da scanGroup. Owner e admin sono gli username con un ruolo in group_roles.
+const groupColumns = `g.group_id, g.admin_id, g.group_name, COALESCE(g.description, ''), g.members,
+	COALESCE(g.photo_id, ''),
+	COALESCE((SELECT group_concat(u.username) FROM group_roles r JOIN users u ON u.id = r.user_id
+	           WHERE r.group_id = g.group_id AND r.role = 'owner'), ''),
+	COALESCE((SELECT group_concat(u.username) FROM group_roles r JOIN users u ON u.id = r.user_id
+	           WHERE r.group_id = g.group_id AND r.role = 'admin'), ''),
+	g.perm_rename, g.perm_change_photo, g.perm_add_members, g.perm_remove_members, g.perm_delete_messages,
+	g.announcement_only`
+
+// groupFrom è la FROM da usare con groupColumns
+const groupFrom = `groups g`
+
+func scanGroup(row rowScanner) (Group, error) {
+	var g Group
+	var membersStr, ownersStr, adminsStr string
+	p := &g.Permissions
+	if err := row.Scan(&g.GroupID, &g.CreatorID, &g.Name, &g.Description, &membersStr, &g.PhotoID, &ownersStr, &adminsStr,
+		&p.Rename, &p.ChangePhoto, &p.AddMembers, &p.RemoveMembers, &p.DeleteMessages, &g.AnnouncementOnly); err != nil {
+		return g, err
+	}
+	g.Members = splitList(membersStr)
+	g.Owners = splitList(ownersStr)
+	g.Admins = splitList(adminsStr)
+	return g, nil
+}
+
+// splitList divide una lista separata da virgole; una stringa vuota è una lista vuota.
+func splitList(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// GetGroup ritorna il gruppo `groupId`.
+func (db *appdbimpl) GetGroup(groupId string) (Group, error) {
+	g, err := scanGroup(db.c.QueryRow(`SELECT `+groupColumns+` FROM `+groupFrom+` WHERE g.group_id = ?`, groupId))
+	if err == sql.ErrNoRows {
+		return g, ErrGroupNotFound
+	}
+	return g, err
+}
+
+// GetGroupsOfUser ritorna i gruppi di cui l'utente è membro.
+func (db *appdbimpl) GetGroupsOfUser(username string) ([]Group, error) {
+	rows, err := db.c.Query(
+		`SELECT `+groupColumns+` FROM `+groupFrom+`
+		  WHERE instr(',' || g.members || ',', ',' || ? || ',') > 0
+		  ORDER BY g.group_name, g.group_id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []Group
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrInviteDoesNotExist = errors.New("invite does not exist")
+var ErrInviteExpired = errors.New("invite expired or used up")
+var ErrJoinRequestDoesNotExist = errors.New("join request does not exist")
+var ErrJoinRequestExists = errors.New("join request already pending")
+
+// GroupInvite è un link di invito a un gruppo. Ogni uso (ingresso diretto o richiesta di ingresso) incrementa Uses.
+type GroupInvite struct {
+	Token            string     `json:"token"`
+	GroupID          string     `json:"group_id"`
+	CreatedBy        uint64     `json:"created_by"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        *time.Time `json:"expires_at,omitempty"`
+	MaxUses          int        `json:"max_uses"` // 0: nessun limite
+	Uses             int        `json:"uses"`
+	RequiresApproval bool       `json:"requires_approval"`
+}
+
+// Usable indica se l'invito può ancora essere usato all'istante `now`.
+func (i GroupInvite) Usable(now time.Time) bool {
+	if i.ExpiresAt != nil && !now.Before(*i.ExpiresAt) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+// JoinRequest è la richiesta di un utente di entrare in un gruppo tramite un invito che richiede approvazione.
+type JoinRequest struct {
+	ID          int64     `json:"request_id"`
+	GroupID     string    `json:"group_id"`
+	UserID      uint64    `json:"user_id"`
+	Username    string    `json:"username"`
+	InviteToken string    `json:"invite_token"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// inviteColumns sono le colonne lette da scanInvite, nello stesso ordine
+const inviteColumns = `token, group_id, created_by, created_at, expires_at, max_uses, uses, requires_approval`
+
+func scanInvite(row rowScanner) (GroupInvite, error) {
+	var i GroupInvite
+	var expiresAt sql.NullTime
+	if err := row.Scan(&i.Token, &i.GroupID, &i.CreatedBy, &i.CreatedAt, &expiresAt, &i.MaxUses, &i.Uses, &i.RequiresApproval); err != nil {
+		return i, err
+	}
+	if expiresAt.Valid {
+		i.ExpiresAt = &expiresAt.Time
+	}
+	return i, nil
+}
+
+// CreateGroupInvite salva un nuovo invito.
+func (db *appdbimpl) CreateGroupInvite(i GroupInvite) error {
+	var expiresAt interface{}
+	if i.ExpiresAt != nil {
+		expiresAt = *i.ExpiresAt
+	}
+	_, err := db.c.Exec(`INSERT INTO group_invites (`+inviteColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		i.Token, i.GroupID, i.CreatedBy, i.CreatedAt, expiresAt, i.MaxUses, i.Uses, i.RequiresApproval)
+	return err
+}
+
+// GetGroupInvites ritorna gli inviti del gruppo, compresi quelli scaduti o esauriti, dal più recente.
+func (db *appdbimpl) GetGroupInvites(groupId string) ([]GroupInvite, error) {
+	rows, err := db.c.Query(`SELECT `+inviteColumns+` FROM group_invites WHERE group_id = ? ORDER BY created_at DESC`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []GroupInvite
+	for rows.Next() {
+		i, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// DeleteGroupInvite revoca l'invito `token` del gruppo. Le richieste già in attesa restano valide.
+func (db *appdbimpl) DeleteGroupInvite(groupId string, token string) error {
+	res, err := db.c.Exec(`DELETE FROM group_invites WHERE group_id = ? AND token = ?`, groupId, token)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrInviteDoesNotExist
+	}
+	return nil
+}
+
+// JoinGroupWithInvite usa l'invito `token` per l'utente: se l'invito richiede approvazione viene creata una richiesta
+// di ingresso e pending è true, altrimenti l'utente diventa subito membro. In entrambi i casi l'uso viene contato.
+func (db *appdbimpl) JoinGroupWithInvite(token string, user User, now time.Time) (groupId string, pending bool, err error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return "", false, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	invite, err := scanInvite(tx.QueryRow(`SELECT `+inviteColumns+` FROM group_invites WHERE token = ?`, token))
+	if err == sql.ErrNoRows {
+		return "", false, ErrInviteDoesNotExist
+	} else if err != nil {
+		return "", false, err
+	}
+	members, err := groupMembersTx(tx, invite.GroupID)
+	if err != nil {
+		return invite.GroupID, false, err
+	}
+	if containsString(members, user.CurrentUsername) {
+		return invite.GroupID, false, ErrMemberAlreadyExists
+	}
+	if !invite.Usable(now) {
+		return invite.GroupID, false, ErrInviteExpired
+	}
+
+	if invite.RequiresApproval {
+		res, err := tx.Exec(
+			`INSERT INTO group_join_requests (group_id, user_id, invite_token, requested_at) VALUES (?, ?, ?, ?)
+			 ON CONFLICT(group_id, user_id) DO NOTHING`,
+			invite.GroupID, user.ID, token, now)
+		if err != nil {
+			return invite.GroupID, false, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return invite.GroupID, false, err
+		} else if n == 0 {
+			return invite.GroupID, true, ErrJoinRequestExists
+		}
+	} else {
+		if err := addGroupMember(tx, invite.GroupID, user.CurrentUsername); err != nil {
+			return invite.GroupID, false, err
+		}
+		if err := insertSystemMessage(tx, invite.GroupID, user, SystemEvent{Event: EventMemberJoined, Subject: user.CurrentUsername}); err != nil {
+			return invite.GroupID, false, err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE group_invites SET uses = uses + 1 WHERE token = ?`, token); err != nil {
+		return invite.GroupID, false, err
+	}
+	return invite.GroupID, invite.RequiresApproval, tx.Commit()
+}
+
+// GetJoinRequests ritorna le richieste di ingresso in attesa per il gruppo, dalla più vecchia.
+func (db *appdbimpl) GetJoinRequests(groupId string) ([]JoinRequest, error) {
+	rows, err := db.c.Query(
+		`SELECT r.id, r.group_id, r.user_id, u.username, r.invite_token, r.requested_at
+		   FROM group_join_requests r JOIN users u ON u.id = r.user_id
+		  WHERE r.group_id = ?
+		  ORDER BY r.requested_at, r.id`, groupId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []JoinRequest
+	for rows.Next() {
+		var jr JoinRequest
+		if err := rows.Scan(&jr.ID, &jr.GroupID, &jr.UserID, &jr.Username, &jr.InviteToken, &jr.RequestedAt); err != nil {
+			return nil, err
+		}
+		requests = append(requests, jr)
+	}
+	return requests, rows.Err()
+}
+
+// ResolveJoinRequest chiude la richiesta `requestID` del gruppo: se approve è true il richiedente viene aggiunto da
+// `actor` (se è già membro nel frattempo, la richiesta viene solo chiusa).
+func (db *appdbimpl) ResolveJoinRequest(groupId string, actor User, requestID int64, approve bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var username string
+	err = tx.QueryRow(
+		`SELECT u.username FROM group_join_requests r JOIN users u ON u.id = r.user_id
+		  WHERE r.id = ? AND r.group_id = ?`, requestID, groupId).Scan(&username)
+	if err == sql.ErrNoRows {
+		return ErrJoinRequestDoesNotExist
+	} else if err != nil {
+		return err
+	}
+
+	if approve {
+		err := addGroupMember(tx, groupId, username)
+		if err == nil {
+			err = insertSystemMessage(tx, groupId, actor, SystemEvent{Event: EventMemberAdded, Subject: username})
+		}
+		if err != nil && !errors.Is(err, ErrMemberAlreadyExists) {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM group_join_requests WHERE id = ?`, requestID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrMuteDoesNotExist = errors.New("member is not muted")
+
+// SettingAnnouncementOnly è il nome dell'impostazione "solo gli admin scrivono" nei messaggi di sistema
+const SettingAnnouncementOnly = "announcement_only"
+
+// GroupMute impedisce a un membro di scrivere nel gruppo fino a ExpiresAt (per sempre se nil), senza rimuoverlo.
+type GroupMute struct {
+	GroupID   string     `json:"group_id"`
+	UserID    uint64     `json:"user_id"`
+	Username  string     `json:"username"`
+	MutedBy   uint64     `json:"muted_by"`
+	MutedAt   time.Time  `json:"muted_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// activeMuteCond seleziona i mute non ancora scaduti; il parametro è l'istante attuale
+const activeMuteCond = `(m.expires_at IS NULL OR julianday(m.expires_at) > julianday(?))`
+
+// muteColumns sono le colonne lette da scanMute, nello stesso ordine
+const muteColumns = `m.group_id, m.user_id, u.username, m.muted_by, m.muted_at, m.expires_at`
+
+func scanMute(row rowScanner) (GroupMute, error) {
+	var m GroupMute
+	var expiresAt sql.NullTime
+	if err := row.Scan(&m.GroupID, &m.UserID, &m.Username, &m.MutedBy, &m.MutedAt, &expiresAt); err != nil {
+		return m, err
+	}
+	if expiresAt.Valid {
+		m.ExpiresAt = &expiresAt.Time
+	}
+	return m, nil
+}
+
+// SetGroupAnnouncementOnly attiva o disattiva la modalità in cui solo owner e admin possono scrivere nel gruppo. Il
+// cambio viene annunciato nella conversazione con un messaggio di sistema; se il valore non cambia non succede nulla.
+func (db *appdbimpl) SetGroupAnnouncementOnly(groupId string, actor User, enabled bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var current bool
+	if err := tx.QueryRow(`SELECT announcement_only FROM groups WHERE group_id = ?`, groupId).Scan(&current); err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	} else if err != nil {
+		return err
+	}
+	if current == enabled {
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPDATE groups SET announcement_only = ? WHERE group_id = ?`, enabled, groupId); err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, groupId, actor, SystemEvent{
+		Event:   EventSettingChanged,
+		Subject: SettingAnnouncementOnly,
+		Old:     strconv.FormatBool(current),
+		New:     strconv.FormatBool(enabled),
+	}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MuteGroupMember silenzia il membro `username` fino a `until` (per sempre se nil), sostituendo un eventuale mute
+// precedente. Il mute resta anche se il membro esce dal gruppo, così non lo si può aggirare rientrando con un invito.
+func (db *appdbimpl) MuteGroupMember(groupId string, username string, actor User, until *time.Time, now time.Time) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	members, err := groupMembersTx(tx, groupId)
+	if err != nil {
+		return err
+	}
+	if !containsString(members, username) {
+		return ErrMemberNotFound
+	}
+	var userID uint64
+	if err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID); err == sql.ErrNoRows {
+		return ErrMemberNotFound
+	} else if err != nil {
+		return err
+	}
+
+	var expiresAt interface{}
+	expires := ""
+	if until != nil {
+		expiresAt = *until
+		expires = until.UTC().Format(time.RFC3339)
+	}
+	_, err = tx.Exec(
+		`INSERT INTO group_mutes (group_id, user_id, muted_by, muted_at, expires_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(group_id, user_id) DO UPDATE
+		   SET muted_by = excluded.muted_by, muted_at = excluded.muted_at, expires_at = excluded.expires_at`,
+		groupId, userID, actor.ID, now, expiresAt)
+	if err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, groupId, actor, SystemEvent{Event: EventMemberMuted, Subject: username, New: expires}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnmuteGroupMember toglie il mute attivo del membro `username`.
+func (db *appdbimpl) UnmuteGroupMember(groupId string, username string, actor User, now time.Time) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(
+		`DELETE FROM group_mutes
+		  WHERE group_id = ? AND user_id IN (SELECT id FROM users WHERE username = ?)
+		    AND (expires_at IS NULL OR julianday(expires_at) > julianday(?))`,
+		groupId, username, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMuteDoesNotExist
+	}
+	if err := insertSystemMessage(tx, groupId, actor, SystemEvent{Event: EventMemberUnmuted, Subject: username}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetGroupMutes ritorna i mute attivi all'istante `now` nel gruppo.
+func (db *appdbimpl) GetGroupMutes(groupId string, now time.Time) ([]GroupMute, error) {
+	rows, err := db.c.Query(
+		`SELECT `+muteColumns+` FROM group_mutes m JOIN users u ON u.id = m.user_id
+		  WHERE m.group_id = ? AND `+activeMuteCond+`
+		  ORDER BY m.muted_at`, groupId, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mutes []GroupMute
+	for rows.Next() {
+		m, err := scanMute(rows)
+		if err != nil {
+			return nil, err
+		}
+		mutes = append(mutes, m)
+	}
+	return mutes, rows.Err()
+}
+
+// GetActiveMute ritorna il mute attivo all'istante `now` dell'utente nel gruppo, o ErrMuteDoesNotExist.
+func (db *appdbimpl) GetActiveMute(groupId string, userID uint64, now time.Time) (GroupMute, error) {
+	m, err := scanMute(db.c.QueryRow(
+		`SELECT `+muteColumns+` FROM group_mutes m JOIN users u ON u.id = m.user_id
+		  WHERE m.group_id = ? AND m.user_id = ? AND `+activeMuteCond, groupId, userID, now))
+	if err == sql.ErrNoRows {
+		return m, ErrMuteDoesNotExist
+	}
+	return m, err
+}
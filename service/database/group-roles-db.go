@@ -0,0 +1,233 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// Ruoli dei membri di un gruppo. In group_roles sono salvati solo owner e admin: chi è in groups.members senza una
+// riga in group_roles è un semplice membro.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// roleRank ordina i ruoli; 0 vuol dire "non membro".
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 3
+	case RoleAdmin:
+		return 2
+	case RoleMember:
+		return 1
+	}
+	return 0
+}
+
+// ValidRole indica se role è uno dei ruoli di un gruppo.
+func ValidRole(role string) bool {
+	return roleRank(role) > 0
+}
+
+// GroupPermissions è la matrice dei permessi di un gruppo: per ogni azione, il ruolo minimo necessario. Gli owner
+// possono sempre fare tutto.
+type GroupPermissions struct {
+	Rename         string `json:"rename"` // nome e descrizione
+	ChangePhoto    string `json:"change_photo"`
+	AddMembers     string `json:"add_members"`
+	RemoveMembers  string `json:"remove_members"`
+	DeleteMessages string `json:"delete_messages"` // messaggi degli altri membri
+}
+
+// Valid indica se tutti i permessi sono ruoli validi.
+func (p GroupPermissions) Valid() bool {
+	for _, role := range []string{p.Rename, p.ChangePhoto, p.AddMembers, p.RemoveMembers, p.DeleteMessages} {
+		if !ValidRole(role) {
+			return false
+		}
+	}
+	return true
+}
+
+// RoleOf ritorna il ruolo di `username` nel gruppo, o una stringa vuota se non è membro.
+func (g Group) RoleOf(username string) string {
+	switch {
+	case !containsString(g.Members, username):
+		return ""
+	case containsString(g.Owners, username):
+		return RoleOwner
+	case containsString(g.Admins, username):
+		return RoleAdmin
+	}
+	return RoleMember
+}
+
+// Can indica se `username` è un membro con un ruolo almeno pari a `minRole`.
+func (g Group) Can(username string, minRole string) bool {
+	rank := roleRank(g.RoleOf(username))
+	return rank > 0 && rank >= roleRank(minRole)
+}
+
+// Outranks indica se `actor` ha un ruolo strettamente superiore a quello di `target`.
+func (g Group) Outranks(actor string, target string) bool {
+	return roleRank(g.RoleOf(actor)) > roleRank(g.RoleOf(target))
+}
+
+// SetGroupRole assegna il ruolo `role` al membro `username`. L'ultimo owner non può perdere il ruolo: deve prima
+// nominarne un altro.
+func (db *appdbimpl) SetGroupRole(groupId string, username string, role string) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	members, err := groupMembersTx(tx, groupId)
+	if err != nil {
+		return err
+	}
+	if !containsString(members, username) {
+		return ErrMemberNotFound
+	}
+	var userID uint64
+	if err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID); err == sql.ErrNoRows {
+		return ErrMemberNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if role != RoleOwner {
+		var isOwner bool
+		var owners int
+		if err := tx.QueryRow(
+			`SELECT COALESCE(SUM(user_id = ?), 0) > 0, COUNT(*) FROM group_roles WHERE group_id = ? AND role = ?`,
+			userID, groupId, RoleOwner).Scan(&isOwner, &owners); err != nil {
+			return err
+		}
+		if isOwner && owners == 1 {
+			return ErrLastOwner
+		}
+	}
+	if err := setGroupRoleTx(tx, groupId, userID, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UpdateGroupPermissions sostituisce la matrice dei permessi del gruppo.
+func (db *appdbimpl) UpdateGroupPermissions(groupId string, p GroupPermissions) error {
+	res, err := db.c.Exec(
+		`UPDATE groups SET perm_rename = ?, perm_change_photo = ?, perm_add_members = ?, perm_remove_members = ?,
+		        perm_delete_messages = ?
+		  WHERE group_id = ?`,
+		p.Rename, p.ChangePhoto, p.AddMembers, p.RemoveMembers, p.DeleteMessages, groupId)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// setGroupRoleTx salva il ruolo di `userID`; RoleMember cancella la riga, perché i membri non sono in group_roles.
+func setGroupRoleTx(tx *sql.Tx, groupId string, userID uint64, role string) error {
+	if role == RoleMember {
+		_, err := tx.Exec(`DELETE FROM group_roles WHERE group_id = ? AND user_id = ?`, groupId, userID)
+		return err
+	}
+	_, err := tx.Exec(
+		`INSERT INTO group_roles (group_id, user_id, role, granted_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(group_id, user_id) DO UPDATE SET role = excluded.role, granted_at = excluded.granted_at`,
+		groupId, userID, role, globaltime.Now())
+	return err
+}
+
+// ensureGroupOwner garantisce che il gruppo abbia un owner tra i suoi membri: se non ce n'è nessuno, il ruolo passa
+// all'admin nominato per primo o, se non ci sono admin, al membro entrato per primo.
+func ensureGroupOwner(tx *sql.Tx, groupId string, members []string) error {
+	var owners int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM group_roles WHERE group_id = ? AND role = ?`, groupId, RoleOwner).Scan(&owners); err != nil {
+		return err
+	}
+	if owners > 0 {
+		return nil
+	}
+
+	var userID uint64
+	err := tx.QueryRow(
+		`SELECT user_id FROM group_roles WHERE group_id = ? AND role = ? ORDER BY granted_at, user_id LIMIT 1`,
+		groupId, RoleAdmin).Scan(&userID)
+	if err == sql.ErrNoRows {
+		for _, m := range members {
+			err = tx.QueryRow(`SELECT id FROM users WHERE username = ?`, m).Scan(&userID)
+			if err != sql.ErrNoRows {
+				break
+			}
+		}
+	}
+	if err == sql.ErrNoRows {
+		// nessun membro corrisponde a un utente
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return setGroupRoleTx(tx, groupId, userID, RoleOwner)
+}
+
+// migrateGroupOwners assegna un owner ai gruppi creati prima dei ruoli: diventa owner l'admin del gruppo, se è ancora
+// un membro, altrimenti vale la regola di ensureGroupOwner.
+func migrateGroupOwners(c *sql.DB) error {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.Exec(
+		`INSERT INTO group_roles (group_id, user_id, role, granted_at)
+		 SELECT g.group_id, u.id, ?, ? FROM groups g JOIN users u ON u.id = g.admin_id
+		  WHERE instr(',' || g.members || ',', ',' || u.username || ',') > 0
+		    AND NOT EXISTS (SELECT 1 FROM group_roles r WHERE r.group_id = g.group_id)`,
+		RoleOwner, globaltime.Now())
+	if err != nil {
+		return err
+	}
+
+	var groups []string
+	rows, err := tx.Query(
+		`SELECT group_id FROM groups g
+		  WHERE NOT EXISTS (SELECT 1 FROM group_roles r WHERE r.group_id = g.group_id AND r.role = ?)`, RoleOwner)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		groups = append(groups, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range groups {
+		members, err := groupMembersTx(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := ensureGroupOwner(tx, id, members); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
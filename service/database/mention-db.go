@@ -0,0 +1,220 @@
+package database
+
+import (
+	"database/sql"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// mentionAllUsername è la parola che, scritta da un admin di un gruppo (@all), menziona tutti i membri
+const mentionAllUsername = "all"
+
+// Mention è un messaggio in cui l'utente è stato menzionato, con l'autore e lo stato di lettura.
+type Mention struct {
+	Message        Message `json:"message"`
+	SenderUsername string  `json:"sender_username"`
+	Read           bool    `json:"read"`
+}
+
+// mentionRx trova le menzioni @username all'inizio del testo o dopo uno spazio, così gli indirizzi email non contano
+var mentionRx = regexp.MustCompile(`(?:^|\s)@([\p{L}\p{N}_.]+)`)
+
+// resolveMentions trova le menzioni nel testo e ritorna le entità di quelle che si riferiscono a partecipanti della
+// conversazione, nell'ordine in cui compaiono. Se mentionAll è true @all menziona tutti i partecipanti. Un punto finale
+// è considerato punteggiatura ("grazie @maria.").
+func resolveMentions(tx *sql.Tx, conversationId string, text string, mentionAll bool) ([]Entity, error) {
+	matches := mentionRx.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	var participantsStr string
+	if err := tx.QueryRow(`SELECT participants FROM conversations WHERE conversation_id = ?`, conversationId).Scan(&participantsStr); err != nil {
+		return nil, err
+	}
+	participants := strings.Split(participantsStr, ",")
+
+	var entities []Entity
+	ids := make(map[string]uint64)
+	for _, match := range matches {
+		// match[2]:match[3] è lo username; la menzione comincia dalla @ che lo precede
+		username := strings.TrimRight(text[match[2]:match[3]], ".")
+		if username == "" {
+			continue
+		}
+		entity := Entity{
+			Offset: utf8.RuneCountInString(text[:match[2]-1]),
+			Length: utf8.RuneCountInString(username) + 1,
+		}
+
+		switch {
+		case mentionAll && username == mentionAllUsername:
+			entity.Type = EntityMentionAll
+		case containsString(participants, username):
+			id, ok := ids[username]
+			if !ok {
+				err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&id)
+				if err == sql.ErrNoRows {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				ids[username] = id
+			}
+			entity.Type, entity.UserID, entity.Username = EntityMention, id, username
+		default:
+			continue
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// mergeMentions aggiunge le menzioni alle entità di formattazione del testo, tranne quelle dentro il codice, e le
+// ordina per posizione.
+func mergeMentions(entities []Entity, mentions []Entity) []Entity {
+	for _, m := range mentions {
+		inCode := false
+		for _, e := range entities {
+			if (e.Type == EntityCode || e.Type == EntityPre) && m.Offset < e.Offset+e.Length && e.Offset < m.Offset+m.Length {
+				inCode = true
+				break
+			}
+		}
+		if !inCode {
+			entities = append(entities, m)
+		}
+	}
+	sort.SliceStable(entities, func(i, j int) bool {
+		a, b := entities[i], entities[j]
+		return a.Offset < b.Offset || (a.Offset == b.Offset && a.Length > b.Length)
+	})
+	return entities
+}
+
+// withoutMentions ritorna le entità tranne le menzioni.
+func withoutMentions(entities []Entity) []Entity {
+	var kept []Entity
+	for _, e := range entities {
+		if e.Type != EntityMention && e.Type != EntityMentionAll {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// insertMentions aggiunge il messaggio `messageId` alla casella delle menzioni degli utenti menzionati nelle entità,
+// escluso chi ha scritto il messaggio. Una menzione @all raggiunge tutti i partecipanti.
+func insertMentions(tx *sql.Tx, conversationId string, messageId int64, senderID string, entities []Entity) error {
+	var userIDs []uint64
+	for _, e := range entities {
+		switch e.Type {
+		case EntityMention:
+			userIDs = append(userIDs, e.UserID)
+		case EntityMentionAll:
+			var participantsStr string
+			if err := tx.QueryRow(`SELECT participants FROM conversations WHERE conversation_id = ?`, conversationId).Scan(&participantsStr); err != nil {
+				return err
+			}
+			for _, username := range strings.Split(participantsStr, ",") {
+				var id uint64
+				err := tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&id)
+				if err == sql.ErrNoRows {
+					continue
+				} else if err != nil {
+					return err
+				}
+				userIDs = append(userIDs, id)
+			}
+		}
+	}
+
+	for _, id := range userIDs {
+		if strconv.FormatUint(id, 10) == senderID {
+			continue
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO mentions (message_id, user_id, conversation_id) VALUES (?, ?, ?)
+			 ON CONFLICT(message_id, user_id) DO NOTHING`,
+			messageId, id, conversationId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMentions ritorna al più `limit` messaggi in cui l'utente è stato menzionato, con ID minore di `before` (tutti se
+// before è 0), dal più recente. Se unreadOnly è true ritorna solo le menzioni non ancora lette. Le conversazioni da
+// cui l'utente è uscito non compaiono.
+func (db *appdbimpl) GetMentions(user User, before int, limit int, unreadOnly bool) ([]Mention, error) {
+	query := `SELECT ` + messageColumns + `, COALESCE(u.username, ''), mt.read_at IS NOT NULL
+		   FROM mentions mt
+		   JOIN messages ON messages.id = mt.message_id
+		   JOIN conversations c ON c.conversation_id = mt.conversation_id
+		   LEFT JOIN users u ON u.id = messages.sender_id
+		  WHERE mt.user_id = ? AND instr(',' || c.participants || ',', ',' || ? || ',') > 0 AND ` + notExpired
+	args := []interface{}{user.ID, user.CurrentUsername, expiryNow()}
+	if before > 0 {
+		query += ` AND messages.id < ?`
+		args = append(args, before)
+	}
+	if unreadOnly {
+		query += ` AND mt.read_at IS NULL`
+	}
+	query += ` ORDER BY messages.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []Mention
+	for rows.Next() {
+		var mt Mention
+		m, err := scanMessage(rows, &mt.SenderUsername, &mt.Read)
+		if err != nil {
+			return nil, err
+		}
+		mt.Message = m
+		mentions = append(mentions, mt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, len(mentions))
+	ids := make([]int, len(mentions))
+	for i, mt := range mentions {
+		messages[i], ids[i] = mt.Message, mt.Message.ID
+	}
+	if err := fillReactions(db.c, messages, ids, user.ID); err != nil {
+		return nil, err
+	}
+	if err := fillPolls(db.c, messages, user.ID); err != nil {
+		return nil, err
+	}
+	for i := range mentions {
+		mentions[i].Message = messages[i]
+	}
+	return mentions, nil
+}
+
+// MarkMentionsRead segna come lette le menzioni dell'utente nei messaggi `messageIds`, o tutte se messageIds è vuoto.
+func (db *appdbimpl) MarkMentionsRead(userID uint64, messageIds []int) error {
+	query := `UPDATE mentions SET read_at = ? WHERE user_id = ? AND read_at IS NULL`
+	args := []interface{}{globaltime.Now(), userID}
+	if len(messageIds) > 0 {
+		query += ` AND message_id IN (` + strings.TrimSuffix(strings.Repeat("?,", len(messageIds)), ",") + `)`
+		for _, id := range messageIds {
+			args = append(args, id)
+		}
+	}
+	_, err := db.c.Exec(query, args...)
+	return err
+}
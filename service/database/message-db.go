@@ -3,123 +3,442 @@ package database
 import (
 	"database/sql"
     "encoding/json"
+	"fmt"
+	"strings"
 	"time"
 	"strconv"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+	"github.com/mattn/go-sqlite3"
 )
 
-func (db *appdbimpl) SendMessage(conversationId string, m Message) (Message, error) {
-    // Serializziamo MessageContent in JSON
-    contentBytes, err := json.Marshal(m.MessageContent)
-    if err != nil {
-        return m, err
-    }
-
-    // Inseriamo il messaggio; qui assumo che la tabella messages abbia le colonne
-    // (conversation_id, message_content, timestamp), senza sender_id
-    res, err := db.c.Exec(
-        `INSERT INTO messages (conversation_id, message_content, timestamp, sender_id)
-        VALUES (?, ?, ?, ?)`,
-        conversationId,
-        string(contentBytes),
-        m.Timestamp,
-        m.SenderID,
-     )
-
-    lastInsertID, err := res.LastInsertId()
-    if err != nil {
-        return m, err
-    }
-    m.ID = int(lastInsertID)
-    return m, nil
+// SendMessage salva il messaggio `m` nella conversazione. Le menzioni dei partecipanti nel testo diventano entità del
+// messaggio e finiscono nella casella delle menzioni; @all menziona tutti solo se mentionAll è true. Il file allegato
+// non può far superare al mittente lo spazio `quota` (0: nessun limite), altrimenti l'errore è ErrStorageQuotaExceeded.
+func (db *appdbimpl) SendMessage(conversationId string, m Message, mentionAll bool, quota int64) (Message, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if m.MessageContent.Type == "text" {
+		mentions, err := resolveMentions(tx, conversationId, m.MessageContent.Text, mentionAll)
+		if err != nil {
+			return m, err
+		}
+		m.MessageContent.Entities = mergeMentions(m.MessageContent.Entities, mentions)
+	}
+
+	// Serializziamo MessageContent in JSON
+	contentBytes, err := json.Marshal(m.MessageContent)
+	if err != nil {
+		return m, err
+	}
+	blobID, blobSize := attachmentBlob(m.MessageContent)
+	if err := checkStorageQuota(tx, m.SenderID, blobID, blobSize, quota); err != nil {
+		return m, err
+	}
+	expiresAt, err := messageExpiry(tx, conversationId, m.Timestamp)
+	if err != nil {
+		return m, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO messages (conversation_id, message_content, timestamp, sender_id, blob_id, blob_size, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		conversationId,
+		string(contentBytes),
+		m.Timestamp,
+		m.SenderID,
+		blobID,
+		blobSize,
+		expiresAt,
+	)
+	if err != nil {
+		return m, err
+	}
+	lastInsertID, err := res.LastInsertId()
+	if err != nil {
+		return m, err
+	}
+	if err := insertMentions(tx, conversationId, lastInsertID, m.SenderID, m.MessageContent.Entities); err != nil {
+		return m, err
+	}
+	// chi scrive ha letto la conversazione e non ha più bisogno della bozza
+	senderID, err := strconv.ParseUint(m.SenderID, 10, 64)
+	if err != nil {
+		return m, err
+	}
+	if err := advanceReadCursor(tx, senderID, conversationId, lastInsertID); err != nil {
+		return m, err
+	}
+	if err := clearDraft(tx, conversationId, senderID); err != nil {
+		return m, err
+	}
+	if err := refreshLastMessage(tx, conversationId); err != nil {
+		return m, err
+	}
+	if err := tx.Commit(); err != nil {
+		return m, err
+	}
+
+	m.ID = int(lastInsertID)
+	m.Reactions = []ReactionSummary{}
+	if expiresAt.Valid {
+		m.ExpiresAt = &expiresAt.Time
+	}
+	return m, nil
+}
+
+// ForwardMessage copia il messaggio `messageId` della conversazione `conversationId` nella conversazione
+// `targetConversationId`, come inviato da `senderID`, e ne ricorda la provenienza in ForwardedFrom. Inoltrando un
+// messaggio già inoltrato la provenienza resta quella originale. La conversazione di origine viene indicata solo se tutti
+// i partecipanti della conversazione di destinazione ne fanno parte, così il forward non rivela conversazioni private.
+// Il file allegato conta nello spazio di chi inoltra, che non può superare `quota` (vedi SendMessage).
+func (db *appdbimpl) ForwardMessage(conversationId string, messageId string, targetConversationId string, senderID uint64, quota int64) (Message, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// 1) Il messaggio originale, con l'eventuale file allegato (che resta lo stesso blob)
+	var blobSize sql.NullInt64
+	orig, err := scanMessage(tx.QueryRow(
+		`SELECT `+messageColumns+`, blob_size FROM messages
+		  WHERE messages.id = ? AND messages.conversation_id = ? AND `+notExpired,
+		messageId, conversationId, expiryNow()), &blobSize)
+	if err == sql.ErrNoRows {
+		return orig, ErrMessageDoesNotExist
+	} else if err != nil {
+		return orig, err
+	}
+	if orig.MessageContent.Type == MessageTypeSystem {
+		return orig, ErrSystemMessage
+	}
+
+	// 2) Le menzioni si riferiscono ai partecipanti della conversazione originale: nel forward restano solo testo e
+	//    formattazione
+	forwardedContent := orig.MessageContent
+	forwardedContent.Entities = withoutMentions(orig.MessageContent.Entities)
+
+	// 3) La provenienza
+	from := ForwardOrigin{
+		SenderID:       orig.SenderID,
+		ConversationID: conversationId,
+		MessageID:      orig.ID,
+		Timestamp:      orig.Timestamp,
+	}
+	if orig.MessageContent.ForwardedFrom != nil {
+		from = *orig.MessageContent.ForwardedFrom
+	} else {
+		err := tx.QueryRow(`SELECT username FROM users WHERE id = ?`, orig.SenderID).Scan(&from.SenderUsername)
+		if err != nil && err != sql.ErrNoRows {
+			return orig, err
+		}
+	}
+	if from.ConversationID != "" {
+		visible, err := participantsIncluded(tx, targetConversationId, from.ConversationID)
+		if err != nil {
+			return orig, err
+		}
+		if !visible {
+			from.ConversationID, from.MessageID = "", 0
+		}
+	}
+	forwardedContent.ForwardedFrom = &from
+
+	forwardBytes, err := json.Marshal(forwardedContent)
+	if err != nil {
+		return orig, err
+	}
+
+	// 4) Inserimento nella conversazione di destinazione
+	blobID, _ := attachmentBlob(forwardedContent)
+	if err := checkStorageQuota(tx, strconv.FormatUint(senderID, 10), blobID, blobSize, quota); err != nil {
+		return orig, err
+	}
+	now := globaltime.Now()
+	// il forward segue il timer dei messaggi effimeri della conversazione di destinazione
+	expiresAt, err := messageExpiry(tx, targetConversationId, now)
+	if err != nil {
+		return orig, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO messages (conversation_id, message_content, timestamp, sender_id, blob_id, blob_size, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		targetConversationId,
+		string(forwardBytes),
+		now,
+		strconv.FormatUint(senderID, 10),
+		blobID,
+		blobSize,
+		expiresAt,
+	)
+	if err != nil {
+		return orig, err
+	}
+	newID, err := res.LastInsertId()
+	if err != nil {
+		return orig, err
+	}
+	if err := advanceReadCursor(tx, senderID, targetConversationId, newID); err != nil {
+		return orig, err
+	}
+	if err := refreshLastMessage(tx, targetConversationId); err != nil {
+		return orig, err
+	}
+	if err := tx.Commit(); err != nil {
+		return orig, err
+	}
+
+	forwarded := Message{
+		ID:             int(newID),
+		ConversationID: targetConversationId,
+		Timestamp:      now,
+		SenderID:       strconv.FormatUint(senderID, 10),
+		MessageContent: forwardedContent,
+		Reactions:      []ReactionSummary{},
+	}
+	if expiresAt.Valid {
+		forwarded.ExpiresAt = &expiresAt.Time
+	}
+	return forwarded, nil
+}
+
+// participantsIncluded dice se tutti i partecipanti della conversazione `inner` sono anche partecipanti della
+// conversazione `outer`. Se `outer` non esiste più ritorna false.
+func participantsIncluded(tx *sql.Tx, inner string, outer string) (bool, error) {
+	var innerStr, outerStr string
+	if err := tx.QueryRow(`SELECT participants FROM conversations WHERE conversation_id = ?`, inner).Scan(&innerStr); err != nil {
+		return false, err
+	}
+	err := tx.QueryRow(`SELECT participants FROM conversations WHERE conversation_id = ?`, outer).Scan(&outerStr)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	outerParticipants := strings.Split(outerStr, ",")
+	for _, p := range strings.Split(innerStr, ",") {
+		if !containsString(outerParticipants, p) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// DeleteMessage cancella il messaggio `messageID` con le sue reaction. Se anySender è false il messaggio deve essere
+// stato inviato da `userID`; altrimenti il chiamante ha già verificato che l'utente possa cancellare i messaggi altrui.
+// I messaggi di sistema non si possono cancellare (ErrSystemMessage).
+func (db *appdbimpl) DeleteMessage(conversationID, messageID string, userID uint64, anySender bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	query := `SELECT id FROM messages WHERE id = ? AND conversation_id = ?`
+	args := []interface{}{messageID, conversationID}
+	if !anySender {
+		query += ` AND sender_id = ?`
+		args = append(args, userID)
+	}
+	ids, err := queryIDs(tx, query, args...)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrMessageDoesNotExist
+	}
+	if system, err := isSystemMessage(tx, messageID); err != nil {
+		return err
+	} else if system {
+		return ErrSystemMessage
+	}
+	if err := deleteMessageRows(tx, ids); err != nil {
+		return err
+	}
+	if err := refreshLastMessage(tx, conversationID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMessages ritorna al più `limit` messaggi della conversazione con ID minore di `before` (tutti se before è 0), dal
+// più recente. Le risposte nei thread non compaiono: di ogni messaggio c'è solo il numero di risposte e l'ora
+// dell'ultima. Le reaction sono raggruppate per emoji; ReactedByMe si riferisce all'utente `userID`.
+func (db *appdbimpl) GetMessages(conversationId string, userID uint64, before int, limit int) ([]Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages
+		WHERE messages.conversation_id = ? AND messages.parent_id IS NULL AND ` + notExpired
+	args := []interface{}{conversationId, expiryNow()}
+	if before > 0 {
+		query += ` AND messages.id < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY messages.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	var ids []int
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+		ids = append(ids, m.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := fillReactions(db.c, messages, ids, userID); err != nil {
+		return nil, err
+	}
+	if err := fillPolls(db.c, messages, userID); err != nil {
+		return nil, err
+	}
+	if err := fillThreadStats(db.c, messages, ids); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// GetMessage ritorna il messaggio `messageId` della conversazione, senza reaction, o ErrMessageDoesNotExist.
+func (db *appdbimpl) GetMessage(conversationId string, messageId string) (Message, error) {
+	m, err := scanMessage(db.c.QueryRow(
+		`SELECT `+messageColumns+` FROM messages WHERE messages.id = ? AND messages.conversation_id = ? AND `+notExpired,
+		messageId, conversationId, expiryNow()))
+	if err == sql.ErrNoRows {
+		return m, ErrMessageDoesNotExist
+	}
+	return m, err
 }
 
-func (db *appdbimpl) ForwardMessage(
-    messageId string,
-    targetConversationId string,
-    recipientUsername string,
-    senderID uint64,                      // ora uint64, come nell’interfaccia
-) (Message, error) {
-    var orig Message
-    var contentStr string
-
-    // 1) Recupera il messaggio originale
-    err := db.c.QueryRow(
-        `SELECT id, message_content, timestamp, sender_id
-           FROM messages
-          WHERE id = ?`,
-        messageId,
-    ).Scan(
-        &orig.ID,
-        &contentStr,
-        &orig.Timestamp,
-        &orig.SenderID,                   // string, ok per scan
-    )
-    if err != nil {
-        if err == sql.ErrNoRows {
-            return orig, ErrMessageDoesNotExist
-        }
-        return orig, err
-    }
-
-    // 2) Unmarshal del JSON in orig.MessageContent
-    if err := json.Unmarshal([]byte(contentStr), &orig.MessageContent); err != nil {
-        return orig, err
-    }
-
-    // 3) (Opzionale) modifica del contenuto per il forward
-    forwardedContent := orig.MessageContent
-
-    // 4) Serializzo di nuovo il MessageContent in JSON
-    forwardBytes, err := json.Marshal(forwardedContent)
-    if err != nil {
-        return orig, err
-    }
-
-    // 5) Inserimento nella conversazione di destinazione,
-    //    convertendo senderID in stringa
-    now := time.Now()
-    res, err := db.c.Exec(
-        `INSERT INTO messages (conversation_id, message_content, timestamp, sender_id)
-         VALUES (?, ?, ?, ?)`,
-        targetConversationId,
-        string(forwardBytes),
-        now,
-        strconv.FormatUint(senderID, 10), // conv uint64->string
-    )
-    if err != nil {
-        return orig, err
-    }
-
-    newID, err := res.LastInsertId()
-    if err != nil {
-        return orig, err
-    }
-
-    // 6) Costruisco il Message inoltrato
-    forwardedMsg := Message{
-        ID:             int(newID),
-        Timestamp:      now,
-        SenderID:       strconv.FormatUint(senderID, 10),
-        MessageContent: forwardedContent,
-        // Preview, Comments, MessageStatus lasciati vuoti
-    }
-
-    return forwardedMsg, nil
+// rowScanner è implementato sia da *sql.Row che da *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func (db *appdbimpl) DeleteMessage(conversationID, messageID string, senderID uint64) error {
-    // opzionalmente verifica che il senderID corrisponda
-    res, err := db.c.Exec(
-        `DELETE FROM messages WHERE id = ? AND conversation_id = ? AND sender_id = ?`,
-        messageID, conversationID, senderID,
-    )
-    if err != nil {
-        return err
-    }
-    n, _ := res.RowsAffected()
-    if n == 0 {
-        return ErrMessageDoesNotExist
-    }
-    return nil
+// messageColumns sono le colonne lette da scanMessage, nello stesso ordine
+const messageColumns = `messages.id, messages.conversation_id, messages.message_content, messages.timestamp, messages.sender_id,
+	COALESCE(messages.parent_id, 0), COALESCE(messages.preview, ''), COALESCE(messages.blob_id, ''), messages.expires_at`
+
+// scanMessage legge una riga con le colonne messageColumns in un Message, decodificando il contenuto e l'anteprima
+// JSON. Le colonne che nella query seguono messageColumns vengono lette in `extra`.
+func scanMessage(row rowScanner, extra ...interface{}) (Message, error) {
+	var m Message
+	var contentStr, previewStr, blobID string
+	var expiresAt sql.NullTime
+	dest := append([]interface{}{&m.ID, &m.ConversationID, &contentStr, &m.Timestamp, &m.SenderID, &m.ParentID, &previewStr, &blobID,
+		&expiresAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return m, err
+	}
+	if expiresAt.Valid {
+		m.ExpiresAt = &expiresAt.Time
+	}
+	if err := json.Unmarshal([]byte(contentStr), &m.MessageContent); err != nil {
+		return m, err
+	}
+	if previewStr != "" {
+		if err := json.Unmarshal([]byte(previewStr), &m.Preview); err != nil {
+			return m, err
+		}
+	}
+	if m.MessageContent.File != nil {
+		m.MessageContent.File.BlobID = blobID
+	}
+	return m, nil
+}
+
+// SetMessagePreview salva l'anteprima del messaggio `messageId`. Se nel frattempo il messaggio è stato cancellato
+// non succede nulla.
+func (db *appdbimpl) SetMessagePreview(conversationId string, messageId int, preview MessagePreview) error {
+	previewBytes, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	_, err = db.c.Exec(`UPDATE messages SET preview = ? WHERE id = ? AND conversation_id = ?`, string(previewBytes), messageId, conversationId)
+	return err
+}
+
+// deleteMessageRows cancella i messaggi `ids` insieme a tutto ciò che li riguarda (commenti, menzioni, pin, stelle,
+// voti dei sondaggi e risposte nei loro thread), dentro la transazione `tx`.
+func deleteMessageRows(tx *sql.Tx, ids []int) error {
+	// a blocchi, per restare sotto il limite di parametri di SQLite
+	const chunk = 500
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > chunk {
+			n = chunk
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", n), ",")
+		args := make([]interface{}, n)
+		for i, id := range ids[:n] {
+			args[i] = id
+		}
+		replies, err := queryIDs(tx, `SELECT id FROM messages WHERE parent_id IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return err
+		}
+		if err := deleteMessageRows(tx, replies); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM comments WHERE message_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM mentions WHERE message_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM pins WHERE message_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM stars WHERE message_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM poll_votes WHERE message_id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM messages WHERE id IN (`+placeholders+`)`, args...); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// queryIDs esegue una query che ritorna una colonna di ID interi.
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
+// parseTimestamp converte un timestamp letto come testo (ad esempio da MIN() o MAX()) nel formato usato dal driver.
+func parseTimestamp(s string) (time.Time, error) {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
@@ -0,0 +1,144 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+var ErrMessageAlreadyPinned = errors.New("message already pinned")
+var ErrTooManyPins = errors.New("too many pinned messages")
+var ErrPinDoesNotExist = errors.New("message is not pinned")
+var ErrNotTopLevel = errors.New("thread replies cannot be pinned")
+
+// Pin è un messaggio fissato in cima a una conversazione.
+type Pin struct {
+	Message          Message   `json:"message"`
+	PinnedBy         uint64    `json:"pinned_by"`
+	PinnedByUsername string    `json:"pinned_by_username"`
+	PinnedAt         time.Time `json:"pinned_at"`
+}
+
+// PinMessage fissa il messaggio `messageId` nella conversazione, se non ci sono già `max` messaggi fissati, e lo
+// annuncia con un messaggio di sistema. Le risposte nei thread e i messaggi di sistema non si possono fissare.
+func (db *appdbimpl) PinMessage(conversationId string, messageId string, actor User, max int) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var parent sql.NullInt64
+	err = tx.QueryRow(`SELECT parent_id FROM messages WHERE id = ? AND conversation_id = ? AND `+notExpired,
+		messageId, conversationId, expiryNow()).Scan(&parent)
+	if err == sql.ErrNoRows {
+		return ErrMessageDoesNotExist
+	} else if err != nil {
+		return err
+	}
+	if parent.Valid {
+		return ErrNotTopLevel
+	}
+	if system, err := isSystemMessage(tx, messageId); err != nil {
+		return err
+	} else if system {
+		return ErrSystemMessage
+	}
+
+	var pinned bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pins WHERE message_id = ?)`, messageId).Scan(&pinned); err != nil {
+		return err
+	} else if pinned {
+		return ErrMessageAlreadyPinned
+	}
+	var count int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pins WHERE conversation_id = ?`, conversationId).Scan(&count); err != nil {
+		return err
+	} else if count >= max {
+		return ErrTooManyPins
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO pins (message_id, conversation_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?)`,
+		messageId, conversationId, actor.ID, globaltime.Now()); err != nil {
+		return err
+	}
+	if err := insertSystemMessage(tx, conversationId, actor, SystemEvent{Event: EventMessagePinned, Subject: messageId}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnpinMessage toglie il messaggio `messageId` da quelli fissati e lo annuncia con un messaggio di sistema.
+func (db *appdbimpl) UnpinMessage(conversationId string, messageId string, actor User) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`DELETE FROM pins WHERE message_id = ? AND conversation_id = ?`, messageId, conversationId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrPinDoesNotExist
+	}
+	if err := insertSystemMessage(tx, conversationId, actor, SystemEvent{Event: EventMessageUnpinned, Subject: messageId}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPins ritorna i messaggi fissati nella conversazione, dal più recente. ReactedByMe si riferisce all'utente
+// `userID`.
+func (db *appdbimpl) GetPins(conversationId string, userID uint64) ([]Pin, error) {
+	rows, err := db.c.Query(
+		`SELECT `+messageColumns+`, p.pinned_by, COALESCE(u.username, ''), p.pinned_at
+		   FROM pins p
+		   JOIN messages ON messages.id = p.message_id
+		   LEFT JOIN users u ON u.id = p.pinned_by
+		  WHERE p.conversation_id = ? AND `+notExpired+`
+		  ORDER BY p.pinned_at DESC, p.message_id DESC`, conversationId, expiryNow())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pins []Pin
+	for rows.Next() {
+		var p Pin
+		m, err := scanMessage(rows, &p.PinnedBy, &p.PinnedByUsername, &p.PinnedAt)
+		if err != nil {
+			return nil, err
+		}
+		p.Message = m
+		pins = append(pins, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, len(pins))
+	ids := make([]int, len(pins))
+	for i, p := range pins {
+		messages[i], ids[i] = p.Message, p.Message.ID
+	}
+	if err := fillReactions(db.c, messages, ids, userID); err != nil {
+		return nil, err
+	}
+	if err := fillPolls(db.c, messages, userID); err != nil {
+		return nil, err
+	}
+	if err := fillThreadStats(db.c, messages, ids); err != nil {
+		return nil, err
+	}
+	for i := range pins {
+		pins[i].Message = messages[i]
+	}
+	return pins, nil
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// MessageTypePoll è il tipo dei messaggi con un sondaggio
+const MessageTypePoll = "poll"
+
+var ErrNotAPoll = errors.New("message is not a poll")
+var ErrPollClosed = errors.New("poll is closed")
+var ErrInvalidPollVote = errors.New("invalid poll vote")
+
+// Poll è il sondaggio di un messaggio di tipo "poll". Domanda, opzioni e impostazioni sono salvate nel contenuto del
+// messaggio; i voti sono nella tabella poll_votes e vengono contati a ogni lettura.
+type Poll struct {
+	Question       string       `json:"question"`
+	Options        []PollOption `json:"options"`
+	MultipleChoice bool         `json:"multiple_choice"`
+	Anonymous      bool         `json:"anonymous"`
+	ClosesAt       *time.Time   `json:"closes_at,omitempty"`
+	Closed         bool         `json:"closed"`
+	TotalVoters    int          `json:"total_voters"`
+}
+
+// PollOption è una delle risposte possibili di un sondaggio. Gli ID vanno da 1 al numero di opzioni.
+type PollOption struct {
+	ID        int      `json:"id"`
+	Text      string   `json:"text"`
+	Votes     int      `json:"votes"`
+	Voters    []string `json:"voters,omitempty"` // solo se il sondaggio non è anonimo
+	VotedByMe bool     `json:"voted_by_me"`
+}
+
+// IsClosed dice se il sondaggio è chiuso all'ora `now`.
+func (p *Poll) IsClosed(now time.Time) bool {
+	return p.ClosesAt != nil && !now.Before(*p.ClosesAt)
+}
+
+// VotePoll registra il voto dell'utente al sondaggio del messaggio `messageId`, sostituendo quello precedente.
+// `optionIDs` deve contenere una sola opzione, o più opzioni diverse se il sondaggio è a scelta multipla.
+func (db *appdbimpl) VotePoll(conversationId string, messageId string, userID uint64, optionIDs []int) (Poll, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Poll{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	poll, err := openPoll(tx, conversationId, messageId)
+	if err != nil {
+		return Poll{}, err
+	}
+	if len(optionIDs) == 0 || (len(optionIDs) > 1 && !poll.MultipleChoice) {
+		return Poll{}, ErrInvalidPollVote
+	}
+	seen := make(map[int]bool, len(optionIDs))
+	for _, id := range optionIDs {
+		if id < 1 || id > len(poll.Options) || seen[id] {
+			return Poll{}, ErrInvalidPollVote
+		}
+		seen[id] = true
+	}
+
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?`, messageId, userID); err != nil {
+		return Poll{}, err
+	}
+	now := globaltime.Now()
+	for _, id := range optionIDs {
+		if _, err := tx.Exec(
+			`INSERT INTO poll_votes (message_id, user_id, option_id, voted_at) VALUES (?, ?, ?, ?)`,
+			messageId, userID, id, now); err != nil {
+			return Poll{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Poll{}, err
+	}
+	return db.getPoll(conversationId, messageId, userID)
+}
+
+// RetractPollVote toglie il voto dell'utente al sondaggio del messaggio `messageId`, se il sondaggio è ancora aperto.
+func (db *appdbimpl) RetractPollVote(conversationId string, messageId string, userID uint64) (Poll, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return Poll{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := openPoll(tx, conversationId, messageId); err != nil {
+		return Poll{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE message_id = ? AND user_id = ?`, messageId, userID); err != nil {
+		return Poll{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Poll{}, err
+	}
+	return db.getPoll(conversationId, messageId, userID)
+}
+
+// openPoll ritorna il sondaggio del messaggio, ErrNotAPoll se il messaggio non è un sondaggio o ErrPollClosed se il
+// sondaggio è chiuso.
+func openPoll(tx *sql.Tx, conversationId string, messageId string) (*Poll, error) {
+	var contentStr string
+	err := tx.QueryRow(`SELECT message_content FROM messages WHERE id = ? AND conversation_id = ? AND `+notExpired,
+		messageId, conversationId, expiryNow()).Scan(&contentStr)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageDoesNotExist
+	} else if err != nil {
+		return nil, err
+	}
+	var content MessageContent
+	if err := json.Unmarshal([]byte(contentStr), &content); err != nil {
+		return nil, err
+	}
+	if content.Type != MessageTypePoll || content.Poll == nil {
+		return nil, ErrNotAPoll
+	}
+	if content.Poll.IsClosed(globaltime.Now()) {
+		return nil, ErrPollClosed
+	}
+	return content.Poll, nil
+}
+
+// getPoll ritorna il sondaggio del messaggio con i voti contati dal punto di vista di `userID`.
+func (db *appdbimpl) getPoll(conversationId string, messageId string, userID uint64) (Poll, error) {
+	m, err := db.GetMessage(conversationId, messageId)
+	if err != nil {
+		return Poll{}, err
+	}
+	if m.MessageContent.Poll == nil {
+		return Poll{}, ErrNotAPoll
+	}
+	messages := []Message{m}
+	if err := fillPolls(db.c, messages, userID); err != nil {
+		return Poll{}, err
+	}
+	return *messages[0].MessageContent.Poll, nil
+}
+
+// fillPolls conta i voti dei sondaggi tra i messaggi e dice se sono chiusi. VotedByMe si riferisce all'utente
+// `userID`; i votanti compaiono solo nei sondaggi non anonimi.
+func fillPolls(c *sql.DB, messages []Message, userID uint64) error {
+	polls := make(map[int]*Poll)
+	var args []interface{}
+	now := globaltime.Now()
+	for i := range messages {
+		p := messages[i].MessageContent.Poll
+		if p == nil {
+			continue
+		}
+		p.Closed = p.IsClosed(now)
+		p.TotalVoters = 0
+		for j := range p.Options {
+			p.Options[j].Votes, p.Options[j].Voters, p.Options[j].VotedByMe = 0, nil, false
+		}
+		polls[messages[i].ID] = p
+		args = append(args, messages[i].ID)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+	rows, err := c.Query(
+		`SELECT v.message_id, v.option_id, v.user_id, COALESCE(u.username, '')
+		   FROM poll_votes v LEFT JOIN users u ON u.id = v.user_id
+		  WHERE v.message_id IN (`+placeholders+`)
+		  ORDER BY v.voted_at, v.user_id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	voters := make(map[int]map[uint64]bool)
+	for rows.Next() {
+		var messageID, optionID int
+		var voterID uint64
+		var username string
+		if err := rows.Scan(&messageID, &optionID, &voterID, &username); err != nil {
+			return err
+		}
+		p := polls[messageID]
+		if optionID < 1 || optionID > len(p.Options) {
+			continue
+		}
+		o := &p.Options[optionID-1]
+		o.Votes++
+		if voterID == userID {
+			o.VotedByMe = true
+		}
+		if !p.Anonymous && username != "" {
+			o.Voters = append(o.Voters, username)
+		}
+		if voters[messageID] == nil {
+			voters[messageID] = make(map[uint64]bool)
+		}
+		voters[messageID][voterID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, p := range polls {
+		p.TotalVoters = len(voters[id])
+	}
+	return nil
+}
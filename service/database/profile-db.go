@@ -4,23 +4,27 @@ import (
 	"database/sql"
 )
 
-func (db *appdbimpl) GetUserPicture(username string) ([]byte, error) {
-	var picture []byte
-	// Esegue la query per ottenere la foto (campo photo) dell'utente
-	if err := db.c.QueryRow(`SELECT photo FROM users WHERE username = ?`, username).Scan(&picture); err != nil {
+// GetUserPicture ritorna l'ID del blob con la foto profilo dell'utente.
+func (db *appdbimpl) GetUserPicture(username string) (string, error) {
+	var picture sql.NullString
+	// Esegue la query per ottenere il riferimento alla foto (campo photo_id) dell'utente
+	if err := db.c.QueryRow(`SELECT photo_id FROM users WHERE username = ?`, username).Scan(&picture); err != nil {
 		if err == sql.ErrNoRows {
-			return nil, ErrUserDoesNotExist
+			return "", ErrUserDoesNotExist
 		}
-		return nil, err
+		return "", err
 	}
-	return picture, nil
+	if !picture.Valid {
+		return "", ErrPhotoDoesNotExist
+	}
+	return picture.String, nil
 }
 
 func (db *appdbimpl) ChangeUserPhoto(u User, photo Photo) error {
-    // Aggiorna la colonna `photo` nella tabella users
+    // Aggiorna la colonna `photo_id` nella tabella users
     _, err := db.c.Exec(
-        `UPDATE users SET photo = ? WHERE id = ?`,
-        photo.File, u.ID,
+        `UPDATE users SET photo_id = ? WHERE id = ?`,
+        photo.BlobID, u.ID,
     )
     return err
-}
\ No newline at end of file
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// advanceReadCursor segna come letti dall'utente i messaggi della conversazione fino a `messageId`. Il cursore di
+// lettura va solo avanti.
+func advanceReadCursor(tx *sql.Tx, userID uint64, conversationId string, messageId int64) error {
+	_, err := tx.Exec(
+		`INSERT INTO read_cursors (user_id, conversation_id, last_read_id) VALUES (?, ?, ?)
+		 ON CONFLICT(user_id, conversation_id) DO UPDATE SET last_read_id = MAX(last_read_id, excluded.last_read_id)`,
+		userID, conversationId, messageId)
+	return err
+}
+
+// MarkConversationRead segna come letti dall'utente i messaggi della conversazione fino a `messageId` compreso, o
+// fino all'ultimo se messageId è 0, insieme alle menzioni in quei messaggi. Un messageId che non fa parte della
+// conversazione ritorna ErrMessageDoesNotExist.
+func (db *appdbimpl) MarkConversationRead(userID uint64, conversationId string, messageId int) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var lastRead int64
+	if messageId > 0 {
+		err = tx.QueryRow(
+			`SELECT id FROM messages WHERE id = ? AND conversation_id = ? AND parent_id IS NULL AND `+notExpired,
+			messageId, conversationId, expiryNow()).Scan(&lastRead)
+	} else {
+		err = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM messages WHERE conversation_id = ? AND parent_id IS NULL`,
+			conversationId).Scan(&lastRead)
+	}
+	if err == sql.ErrNoRows {
+		return ErrMessageDoesNotExist
+	} else if err != nil {
+		return err
+	}
+	if lastRead == 0 {
+		// nessun messaggio da leggere
+		return nil
+	}
+
+	if err := advanceReadCursor(tx, userID, conversationId, lastRead); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`UPDATE mentions SET read_at = ?
+		  WHERE user_id = ? AND conversation_id = ? AND message_id <= ? AND read_at IS NULL`,
+		globaltime.Now(), userID, conversationId, lastRead); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
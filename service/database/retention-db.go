@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Origine della retention effettiva di una conversazione
+const (
+	RetentionFromDefault      = "default"
+	RetentionFromConversation = "conversation"
+)
+
+// RetentionReport descrive, per una conversazione, la retention effettiva e i messaggi che il purger cancellerebbe.
+type RetentionReport struct {
+	ConversationID  string     `json:"conversation_id"`
+	RetentionDays   int        `json:"retention_days"` // 0: i messaggi non scadono
+	Source          string     `json:"source"`
+	ExpiredMessages int        `json:"expired_messages"`
+	OldestExpired   *time.Time `json:"oldest_expired,omitempty"`
+}
+
+// expiredMessagesCond seleziona i messaggi `m` scaduti secondo la policy `p` della loro conversazione (o quella di
+// default). Parametri: giorni di default, ora attuale, giorni di default.
+const expiredMessagesCond = `COALESCE(p.days, ?) > 0
+	AND julianday(m.timestamp) < julianday(?) - COALESCE(p.days, ?)`
+
+// SetRetentionPolicy imposta la retention (in giorni, 0 per non cancellare mai) dei messaggi della conversazione,
+// che prevale su quella di default. Con days nil la conversazione torna a usare la retention di default.
+// Per i gruppi, `conversationId` è l'ID del gruppo.
+func (db *appdbimpl) SetRetentionPolicy(conversationId string, days *int) error {
+	if days == nil {
+		_, err := db.c.Exec(`DELETE FROM retention_policies WHERE conversation_id = ?`, conversationId)
+		return err
+	}
+	_, err := db.c.Exec(
+		`INSERT INTO retention_policies (conversation_id, days) VALUES (?, ?)
+		 ON CONFLICT(conversation_id) DO UPDATE SET days = excluded.days`,
+		conversationId, *days)
+	return err
+}
+
+// GetRetentionReport calcola, senza cancellare nulla, quanti messaggi di ogni conversazione sono scaduti all'istante
+// `now` con retention di default `defaultDays`.
+func (db *appdbimpl) GetRetentionReport(defaultDays int, now time.Time) ([]RetentionReport, error) {
+	rows, err := db.c.Query(`
+		SELECT c.conversation_id, p.days,
+		       (SELECT COUNT(*) FROM messages m WHERE m.conversation_id = c.conversation_id AND `+expiredMessagesCond+`),
+		       (SELECT MIN(m.timestamp) FROM messages m WHERE m.conversation_id = c.conversation_id AND `+expiredMessagesCond+`)
+		  FROM conversations c
+		  LEFT JOIN retention_policies p ON p.conversation_id = c.conversation_id
+		 ORDER BY c.conversation_id`,
+		defaultDays, now, defaultDays, defaultDays, now, defaultDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []RetentionReport
+	for rows.Next() {
+		var r RetentionReport
+		var days sql.NullInt64
+		var oldest sql.NullString
+		if err := rows.Scan(&r.ConversationID, &days, &r.ExpiredMessages, &oldest); err != nil {
+			return nil, err
+		}
+		r.RetentionDays, r.Source = defaultDays, RetentionFromDefault
+		if days.Valid {
+			r.RetentionDays, r.Source = int(days.Int64), RetentionFromConversation
+		}
+		if oldest.Valid {
+			// MIN() perde il tipo DATETIME della colonna: il valore va riconvertito
+			if t, err := parseTimestamp(oldest.String); err == nil {
+				r.OldestExpired = &t
+			}
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+// PurgeExpiredMessages cancella al più `limit` messaggi scaduti all'istante `now`, con i loro commenti, e aggiorna
+// last_message delle conversazioni coinvolte. Ritorna il numero di messaggi cancellati.
+func (db *appdbimpl) PurgeExpiredMessages(defaultDays int, now time.Time, limit int) (int, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	rows, err := tx.Query(`
+		SELECT m.id, m.conversation_id
+		  FROM messages m
+		  LEFT JOIN retention_policies p ON p.conversation_id = m.conversation_id
+		 WHERE `+expiredMessagesCond+`
+		 ORDER BY m.id
+		 LIMIT ?`,
+		defaultDays, now, defaultDays, limit)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	conversations := make(map[string]bool)
+	for rows.Next() {
+		var id int
+		var conversationId string
+		if err := rows.Scan(&id, &conversationId); err != nil {
+			_ = rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		conversations[conversationId] = true
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if err := deleteMessageRows(tx, ids); err != nil {
+		return 0, err
+	}
+	for conversationId := range conversations {
+		if err := refreshLastMessage(tx, conversationId); err != nil {
+			return 0, err
+		}
+	}
+	return len(ids), tx.Commit()
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+var ErrStarDoesNotExist = errors.New("message is not starred")
+
+// Starred è un messaggio che l'utente ha aggiunto ai preferiti.
+type Starred struct {
+	Message   Message   `json:"message"`
+	StarredAt time.Time `json:"starred_at"`
+}
+
+// StarMessage aggiunge il messaggio ai preferiti dell'utente. Se c'è già non succede nulla.
+func (db *appdbimpl) StarMessage(conversationId string, messageId string, userID uint64) error {
+	if err := db.checkMessageInConversation(conversationId, messageId); err != nil {
+		return err
+	}
+	_, err := db.c.Exec(
+		`INSERT INTO stars (user_id, message_id, conversation_id, starred_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(user_id, message_id) DO NOTHING`,
+		userID, messageId, conversationId, globaltime.Now())
+	return err
+}
+
+// UnstarMessage toglie il messaggio dai preferiti dell'utente.
+func (db *appdbimpl) UnstarMessage(conversationId string, messageId string, userID uint64) error {
+	res, err := db.c.Exec(`DELETE FROM stars WHERE user_id = ? AND message_id = ? AND conversation_id = ?`,
+		userID, messageId, conversationId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrStarDoesNotExist
+	}
+	return nil
+}
+
+// GetStarred ritorna al più `limit` messaggi preferiti dell'utente, dall'ultimo aggiunto, eventualmente solo quelli
+// della conversazione `conversationId`. `cursor` è il valore next ritornato dalla pagina precedente (0 per la prima);
+// next è 0 se non ci sono altre pagine. L'accesso viene verificato alla lettura: i messaggi delle conversazioni da cui
+// l'utente è uscito non compaiono, ma restano tra i preferiti se ci rientra.
+func (db *appdbimpl) GetStarred(user User, conversationId string, cursor int64, limit int) (starred []Starred, next int64, err error) {
+	query := `SELECT ` + messageColumns + `, s.id, s.starred_at
+		   FROM stars s
+		   JOIN messages ON messages.id = s.message_id
+		   JOIN conversations c ON c.conversation_id = s.conversation_id
+		  WHERE s.user_id = ? AND instr(',' || c.participants || ',', ',' || ? || ',') > 0 AND ` + notExpired
+	args := []interface{}{user.ID, user.CurrentUsername, expiryNow()}
+	if conversationId != "" {
+		query += ` AND s.conversation_id = ?`
+		args = append(args, conversationId)
+	}
+	if cursor > 0 {
+		query += ` AND s.id < ?`
+		args = append(args, cursor)
+	}
+	// una riga in più per sapere se c'è un'altra pagina
+	query += ` ORDER BY s.id DESC LIMIT ?`
+	args = append(args, limit+1)
+
+	rows, err := db.c.Query(query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var starIDs []int64
+	for rows.Next() {
+		var st Starred
+		var starID int64
+		m, err := scanMessage(rows, &starID, &st.StarredAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		st.Message = m
+		starred = append(starred, st)
+		starIDs = append(starIDs, starID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(starred) > limit {
+		starred = starred[:limit]
+		next = starIDs[limit-1]
+	}
+
+	messages := make([]Message, len(starred))
+	ids := make([]int, len(starred))
+	for i, st := range starred {
+		messages[i], ids[i] = st.Message, st.Message.ID
+	}
+	if err := fillReactions(db.c, messages, ids, user.ID); err != nil {
+		return nil, 0, err
+	}
+	if err := fillPolls(db.c, messages, user.ID); err != nil {
+		return nil, 0, err
+	}
+	for i := range starred {
+		starred[i].Message = messages[i]
+	}
+	return starred, next, nil
+}
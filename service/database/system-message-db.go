@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+var ErrSystemMessage = errors.New("system messages cannot be changed")
+
+// MessageTypeSystem è il tipo dei messaggi generati dal server per gli eventi di una conversazione. I client non
+// possono inviarli.
+const MessageTypeSystem = "system"
+
+// Eventi dei messaggi di sistema
+const (
+	EventMemberAdded         = "member_added"         // Subject: nuovo membro
+	EventMemberJoined        = "member_joined"        // Subject: nuovo membro, entrato con un invito
+	EventMemberLeft          = "member_left"          // Subject: chi è uscito
+	EventMemberRemoved       = "member_removed"       // Subject: membro rimosso
+	EventGroupRenamed        = "group_renamed"        // Old, New: nomi
+	EventDescriptionChanged  = "description_changed"  // Old, New: descrizioni
+	EventPhotoChanged        = "photo_changed"        // Old, New: ID dei blob delle foto
+	EventSettingChanged      = "setting_changed"      // Subject: nome dell'impostazione
+	EventMemberMuted         = "member_muted"         // Subject: membro; New: scadenza RFC 3339, vuota se non scade
+	EventMemberUnmuted       = "member_unmuted"       // Subject: membro
+	EventMessagePinned       = "message_pinned"       // Subject: ID del messaggio
+	EventMessageUnpinned     = "message_unpinned"     // Subject: ID del messaggio
+	EventDisappearingChanged = "disappearing_changed" // Old, New: timer dei messaggi effimeri
+)
+
+// SystemEvent descrive un evento di una conversazione in forma strutturata, così i client possono mostrarlo nella
+// propria lingua. Actor e Subject sono username.
+type SystemEvent struct {
+	Event   string `json:"event"`
+	Actor   string `json:"actor"`
+	Subject string `json:"subject,omitempty"`
+	Old     string `json:"old,omitempty"`
+	New     string `json:"new,omitempty"`
+}
+
+// Summary ritorna una descrizione in inglese dell'evento, usata come anteprima nella lista delle conversazioni.
+func (e SystemEvent) Summary() string {
+	switch e.Event {
+	case EventMemberAdded:
+		return e.Actor + " added " + e.Subject
+	case EventMemberJoined:
+		return e.Subject + " joined"
+	case EventMemberLeft:
+		return e.Subject + " left"
+	case EventMemberRemoved:
+		return e.Actor + " removed " + e.Subject
+	case EventGroupRenamed:
+		return e.Actor + " renamed the group to " + e.New
+	case EventDescriptionChanged:
+		return e.Actor + " changed the group description"
+	case EventPhotoChanged:
+		return e.Actor + " changed the group photo"
+	case EventSettingChanged:
+		return e.Actor + " changed " + e.Subject + " to " + e.New
+	case EventMemberMuted:
+		return e.Actor + " muted " + e.Subject
+	case EventMemberUnmuted:
+		return e.Actor + " unmuted " + e.Subject
+	case EventMessagePinned:
+		return e.Actor + " pinned a message"
+	case EventMessageUnpinned:
+		return e.Actor + " unpinned a message"
+	case EventDisappearingChanged:
+		if e.New == DisappearingOff {
+			return e.Actor + " turned off disappearing messages"
+		}
+		return e.Actor + " set disappearing messages to " + e.New
+	}
+	return e.Event
+}
+
+// insertSystemMessage aggiunge alla conversazione un messaggio di sistema per l'evento. Il mittente è chi ha causato
+// l'evento.
+func insertSystemMessage(tx *sql.Tx, conversationId string, actor User, event SystemEvent) error {
+	event.Actor = actor.CurrentUsername
+	content, err := json.Marshal(MessageContent{Type: MessageTypeSystem, System: &event})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO messages (conversation_id, message_content, timestamp, sender_id) VALUES (?, ?, ?, ?)`,
+		conversationId, string(content), globaltime.Now(), strconv.FormatUint(actor.ID, 10)); err != nil {
+		return err
+	}
+	return refreshLastMessage(tx, conversationId)
+}
+
+// isSystemMessage dice se il messaggio `messageID` è un messaggio di sistema. I messaggi di sistema fanno parte della
+// storia della conversazione: nessun utente può cancellarli, modificarli o inoltrarli.
+func isSystemMessage(tx *sql.Tx, messageID string) (bool, error) {
+	var contentStr string
+	if err := tx.QueryRow(`SELECT message_content FROM messages WHERE id = ?`, messageID).Scan(&contentStr); err != nil {
+		return false, err
+	}
+	var content MessageContent
+	if err := json.Unmarshal([]byte(contentStr), &content); err != nil {
+		return false, err
+	}
+	return content.Type == MessageTypeSystem, nil
+}
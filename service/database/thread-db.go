@@ -0,0 +1,159 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrReplyToReply = errors.New("cannot reply to a thread reply")
+
+// ReplyToMessage aggiunge la risposta `m` al thread del messaggio `parentId`, salvando le menzioni dei partecipanti
+// (anche @all se mentionAll è true). Si può rispondere solo ai messaggi della conversazione, non alle risposte.
+func (db *appdbimpl) ReplyToMessage(conversationId string, parentId string, m Message, mentionAll bool) (Message, error) {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var grandparent sql.NullInt64
+	err = tx.QueryRow(`SELECT parent_id FROM messages WHERE id = ? AND conversation_id = ? AND `+notExpired,
+		parentId, conversationId, expiryNow()).Scan(&grandparent)
+	if err == sql.ErrNoRows {
+		return m, ErrMessageDoesNotExist
+	} else if err != nil {
+		return m, err
+	}
+	if grandparent.Valid {
+		return m, ErrReplyToReply
+	}
+
+	mentions, err := resolveMentions(tx, conversationId, m.MessageContent.Text, mentionAll)
+	if err != nil {
+		return m, err
+	}
+	m.MessageContent.Entities = mergeMentions(m.MessageContent.Entities, mentions)
+	content, err := json.Marshal(m.MessageContent)
+	if err != nil {
+		return m, err
+	}
+	expiresAt, err := messageExpiry(tx, conversationId, m.Timestamp)
+	if err != nil {
+		return m, err
+	}
+	res, err := tx.Exec(
+		`INSERT INTO messages (conversation_id, message_content, timestamp, sender_id, parent_id, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		conversationId, string(content), m.Timestamp, m.SenderID, parentId, expiresAt)
+	if err != nil {
+		return m, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return m, err
+	}
+	if err := insertMentions(tx, conversationId, id, m.SenderID, m.MessageContent.Entities); err != nil {
+		return m, err
+	}
+	if err := tx.Commit(); err != nil {
+		return m, err
+	}
+
+	m.ID = int(id)
+	m.ConversationID = conversationId
+	m.ParentID, _ = strconv.Atoi(parentId)
+	m.Reactions = []ReactionSummary{}
+	if expiresAt.Valid {
+		m.ExpiresAt = &expiresAt.Time
+	}
+	return m, nil
+}
+
+// GetThread ritorna al più `limit` risposte del thread del messaggio `parentId` con ID maggiore di `after`, dalla più
+// vecchia. ReactedByMe si riferisce all'utente `userID`.
+func (db *appdbimpl) GetThread(conversationId string, parentId string, userID uint64, after int, limit int) ([]Message, error) {
+	if err := db.checkMessageInConversation(conversationId, parentId); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.c.Query(
+		`SELECT `+messageColumns+` FROM messages
+		  WHERE messages.conversation_id = ? AND messages.parent_id = ? AND messages.id > ? AND `+notExpired+`
+		  ORDER BY messages.id LIMIT ?`, conversationId, parentId, after, expiryNow(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var replies []Message
+	var ids []int
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, m)
+		ids = append(ids, m.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := fillReactions(db.c, replies, ids, userID); err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// fillThreadStats imposta il numero di risposte e l'ora dell'ultima risposta dei messaggi, i cui ID sono `ids`.
+func fillThreadStats(c *sql.DB, messages []Message, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := c.Query(
+		`SELECT parent_id, COUNT(*), MAX(timestamp) FROM messages
+		  WHERE parent_id IN (`+placeholders+`) AND `+notExpired+`
+		  GROUP BY parent_id`, append(args, expiryNow())...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type stats struct {
+		count int
+		last  string
+	}
+	byParent := make(map[int]stats)
+	for rows.Next() {
+		var parent int
+		var s stats
+		if err := rows.Scan(&parent, &s.count, &s.last); err != nil {
+			return err
+		}
+		byParent[parent] = s
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		s, ok := byParent[messages[i].ID]
+		if !ok {
+			continue
+		}
+		last, err := parseTimestamp(s.last)
+		if err != nil {
+			return err
+		}
+		messages[i].ReplyCount = s.count
+		messages[i].LastReplyAt = &last
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 )
 
 func (db *appdbimpl) CreateUser(u User) (User, error) {
@@ -33,8 +35,17 @@ func (db *appdbimpl) CreateUser(u User) (User, error) {
 	return u, nil
 }
 
+// SetUsername cambia lo username dell'utente da `username` a u.CurrentUsername. Membri dei gruppi e partecipanti delle
+// conversazioni sono salvati per username, quindi vengono aggiornati nella stessa transazione: altrimenti l'utente
+// perderebbe i suoi gruppi e chi registra il vecchio nome li erediterebbe.
 func (db *appdbimpl) SetUsername(u User, username string) (User, error) {
-	res, err := db.c.Exec(`UPDATE users SET Username=? WHERE Id=? AND Username=?`, u.CurrentUsername, u.ID, username)
+	tx, err := db.c.Begin()
+	if err != nil {
+		return u, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`UPDATE users SET Username=? WHERE Id=? AND Username=?`, u.CurrentUsername, u.ID, username)
 	if err != nil {
 		return u, err
 	}
@@ -44,7 +55,17 @@ func (db *appdbimpl) SetUsername(u User, username string) (User, error) {
 	} else if affected == 0 {
 		return u, err
 	}
-	return u, nil
+	for _, stmt := range []string{
+		`UPDATE groups SET members = trim(replace(',' || members || ',', ',' || ? || ',', ',' || ? || ','), ',')
+		  WHERE instr(',' || members || ',', ',' || ? || ',') > 0`,
+		`UPDATE conversations SET participants = trim(replace(',' || participants || ',', ',' || ? || ',', ',' || ? || ','), ',')
+		  WHERE instr(',' || participants || ',', ',' || ? || ',') > 0`,
+	} {
+		if _, err := tx.Exec(stmt, username, u.CurrentUsername, username); err != nil {
+			return u, err
+		}
+	}
+	return u, tx.Commit()
 }
 
 func (db *appdbimpl) GetUserId(username string) (User, error) {
@@ -85,4 +106,216 @@ func (db *appdbimpl) CheckUser(u User) (User, error) {
 		}
 	}
 	return user, nil
-}
\ No newline at end of file
+}
+// checkUsersExist controlla che esistano tutti gli utenti `usernames`; per il primo che non esiste ritorna
+// ErrUserDoesNotExist con il suo username.
+func checkUsersExist(tx *sql.Tx, usernames []string) error {
+	for _, name := range usernames {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)`, name).Scan(&exists); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("%w: %s", ErrUserDoesNotExist, name)
+		}
+	}
+	return nil
+}
+
+// DeletedUserID è il sender_id dei messaggi anonimizzati di un account cancellato. Gli ID degli utenti partono da 1,
+// quindi non può corrispondere a un utente reale.
+const DeletedUserID = 0
+
+// DeleteUser cancella l'account `userID` e tutto ciò che lo riguarda in un'unica transazione:
+//   - l'utente esce dai gruppi, con un messaggio di sistema come quando esce da solo; se era l'ultimo owner, il
+//     ruolo passa a un altro membro (un gruppo senza membri viene cancellato);
+//   - l'utente viene rimosso dai partecipanti delle conversazioni (una conversazione senza partecipanti viene
+//     cancellata con i suoi messaggi);
+//   - i suoi messaggi vengono cancellati oppure, se anonymizeMessages è true, attribuiti a DeletedUserID;
+//   - le sue reaction, le sue menzioni, i messaggi preferiti e i suoi export vengono cancellati.
+//
+// La foto e gli archivi di export restano nel blob store finché il garbage collector non li rimuove. Non ci sono
+// sessioni da invalidare: il token è l'ID dell'utente, che non viene mai riassegnato.
+func (db *appdbimpl) DeleteUser(userID uint64, anonymizeMessages bool) error {
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var username string
+	if err := tx.QueryRow(`SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrUserDoesNotExist
+		}
+		return err
+	}
+	// 1) Gruppi: l'uscita segue le regole di removeGroupMember (passaggio di proprietà, gruppi vuoti cancellati)
+	var groups []string
+	rows, err := tx.Query(
+		`SELECT group_id FROM groups WHERE instr(',' || members || ',', ',' || ? || ',') > 0`, username)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		groups = append(groups, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// Il messaggio di uscita ha come mittente DeletedUserID, così resta anche quando i messaggi dell'utente vengono
+	// cancellati al passo 3
+	leaver := User{ID: DeletedUserID, CurrentUsername: username}
+	for _, id := range groups {
+		exists, err := removeGroupMember(tx, id, username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := insertSystemMessage(tx, id, leaver, SystemEvent{Event: EventMemberLeft, Subject: username}); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM group_roles WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM group_join_requests WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM group_mutes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	// 2) Conversazioni
+	type convRow struct {
+		id           string
+		participants []string
+	}
+	var convs []convRow
+	rows, err = tx.Query(
+		`SELECT conversation_id, participants FROM conversations
+		  WHERE instr(',' || participants || ',', ',' || ? || ',') > 0`, username)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c convRow
+		var participantsStr string
+		if err := rows.Scan(&c.id, &participantsStr); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		c.participants = strings.Split(participantsStr, ",")
+		convs = append(convs, c)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range convs {
+		var remaining []string
+		for _, p := range c.participants {
+			if p != "" && p != username {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) > 0 {
+			if _, err := tx.Exec(`UPDATE conversations SET participants = ? WHERE conversation_id = ?`,
+				strings.Join(remaining, ","), c.id); err != nil {
+				return err
+			}
+			continue
+		}
+		ids, err := queryIDs(tx, `SELECT id FROM messages WHERE conversation_id = ?`, c.id)
+		if err != nil {
+			return err
+		}
+		if err := deleteMessageRows(tx, ids); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM drafts WHERE conversation_id = ?`, c.id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM read_cursors WHERE conversation_id = ?`, c.id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM conversations WHERE conversation_id = ?`, c.id); err != nil {
+			return err
+		}
+	}
+
+	// 3) Messaggi, poi l'anteprima delle conversazioni in cui c'erano (l'ultimo messaggio può essere sparito o avere
+	//    un altro mittente)
+	var touched []string
+	rows, err = tx.Query(
+		`SELECT DISTINCT conversation_id FROM messages WHERE sender_id = ?
+		 UNION SELECT conversation_id FROM conversations WHERE last_sender_id = ?`, userID, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		touched = append(touched, id)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if anonymizeMessages {
+		if _, err := tx.Exec(`UPDATE messages SET sender_id = ? WHERE sender_id = ?`, DeletedUserID, userID); err != nil {
+			return err
+		}
+	} else {
+		ids, err := queryIDs(tx, `SELECT id FROM messages WHERE sender_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+		if err := deleteMessageRows(tx, ids); err != nil {
+			return err
+		}
+	}
+	for _, id := range touched {
+		if err := refreshLastMessage(tx, id); err != nil {
+			return err
+		}
+	}
+
+	// 4) Reaction, menzioni, preferiti, voti, export e infine l'utente
+	if _, err := tx.Exec(`DELETE FROM comments WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM mentions WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM stars WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM drafts WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM read_cursors WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM poll_votes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM exports WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,91 @@
+package linkpreview
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// reservedNetworks are the networks not covered by the net.IP methods that must not be reachable from the server
+var reservedNetworks = mustParseNetworks(
+	"0.0.0.0/8",       // "this" network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved, broadcast included
+	"64:ff9b::/96",    // NAT64, can reach IPv4 private addresses
+	"2001:db8::/32",   // documentation
+)
+
+// checkAddress is the Control function of the dialer: it refuses connections to forbidden addresses. address is the
+// resolved "ip:port" that is going to be dialed.
+func (f *Fetcher) checkAddress(network string, address string, _ syscall.RawConn) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	for _, n := range f.allowed {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if (port != "80" && port != "443") || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	return nil
+}
+
+// publicIP reports whether ip is a public unicast address
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNetwork parses an IP address or a CIDR network
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowed network %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed network %q", s)
+	}
+	return n, nil
+}
+
+func mustParseNetworks(networks ...string) []*net.IPNet {
+	var parsed []*net.IPNet
+	for _, s := range networks {
+		n, err := parseNetwork(s)
+		if err != nil {
+			panic(err)
+		}
+		parsed = append(parsed, n)
+	}
+	return parsed
+}
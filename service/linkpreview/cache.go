@@ -0,0 +1,72 @@
+package linkpreview
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/flbonanni/WASAText/service/globaltime"
+)
+
+// cache keeps the results of the last fetches, up to size URLs, for ttl. When full, the least recently used entry is
+// evicted.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	preview Preview
+	err     error
+	expires time.Time
+}
+
+func newCache(size int, ttl time.Duration) *cache {
+	return &cache{
+		size:    size,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached result for key; ok is false if there is none or it has expired.
+func (c *cache) get(key string) (p Preview, err error, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[key]
+	if !found {
+		return Preview{}, nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !globaltime.Now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return Preview{}, nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.preview, e.err, true
+}
+
+func (c *cache) put(key string, p Preview, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &cacheEntry{key: key, preview: p, err: err, expires: globaltime.Now().Add(c.ttl)}
+	if el, found := c.entries[key]; found {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
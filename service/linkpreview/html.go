@@ -0,0 +1,86 @@
+package linkpreview
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum length (in characters) of the title and the description of a preview
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 500
+)
+
+var (
+	headEndRx = regexp.MustCompile(`(?i)<body[\s>]|</head\s*>`)
+	metaRx    = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrRx    = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	titleRx   = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title\s*>`)
+	spaceRx   = regexp.MustCompile(`\s+`)
+)
+
+// parseHTML reads the preview from the meta tags in the head of the page: OpenGraph first, then Twitter cards, then
+// the <title> and the description meta tag. base is the URL of the page, used to resolve a relative image URL.
+func parseHTML(page string, base *url.URL) Preview {
+	if loc := headEndRx.FindStringIndex(page); loc != nil {
+		page = page[:loc[0]]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range metaRx.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, a := range attrRx.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(a[1])] = a[2] + a[3] + a[4]
+		}
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		name = strings.ToLower(name)
+		if _, seen := meta[name]; name != "" && !seen {
+			meta[name] = clean(attrs["content"])
+		}
+	}
+
+	var p Preview
+	p.Title = first(meta["og:title"], meta["twitter:title"])
+	if p.Title == "" {
+		if m := titleRx.FindStringSubmatch(page); m != nil {
+			p.Title = clean(m[1])
+		}
+	}
+	p.Description = first(meta["og:description"], meta["twitter:description"], meta["description"])
+	p.Title = truncate(p.Title, maxTitleLength)
+	p.Description = truncate(p.Description, maxDescriptionLength)
+
+	if image := first(meta["og:image:secure_url"], meta["og:image"], meta["twitter:image"]); image != "" {
+		if u, err := base.Parse(image); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			p.ImageURL = u.String()
+		}
+	}
+	return p
+}
+
+// clean decodes HTML entities and collapses white space
+func clean(s string) string {
+	return strings.TrimSpace(spaceRx.ReplaceAllString(html.UnescapeString(s), " "))
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	return string([]rune(s)[:max-1]) + "…"
+}
@@ -0,0 +1,221 @@
+/*
+Package linkpreview fetches the title, description and image of web pages, read from their OpenGraph and HTML meta
+tags, to show a preview of the links sent in messages.
+
+Pages are fetched with strict limits: every fetch has a timeout, only the first MaxSize bytes of a page are read, only
+http and https URLs on the standard ports are allowed and, to prevent server-side request forgery, the fetcher never
+connects to loopback, private, link-local or otherwise reserved addresses. The check is done on the address actually
+dialed, so DNS names resolving to private addresses and redirects to them are refused as well. Networks listed in
+Config.AllowedNetworks are exempt from these checks (for example an intranet, or the 127.0.0.1 address of an
+httptest.Server in tests).
+
+Results, including failures, are cached for Config.CacheTTL.
+
+Example:
+
+	fetcher, err := linkpreview.New(linkpreview.Config{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	if url := linkpreview.FindURL(text); url != "" {
+		preview, err := fetcher.Fetch(ctx, url)
+		...
+	}
+*/
+package linkpreview
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrInvalidURL = errors.New("invalid URL")
+var ErrForbiddenAddress = errors.New("address not allowed")
+var ErrNotHTML = errors.New("not an HTML page")
+var ErrNoMetadata = errors.New("page has no title or description")
+
+// Default limits, used for the zero values of Config
+const (
+	DefaultTimeout   = 5 * time.Second
+	DefaultMaxSize   = 512 << 10
+	DefaultCacheTTL  = time.Hour
+	DefaultCacheSize = 1000
+	maxRedirects     = 5
+)
+
+// Preview is the metadata of a web page
+type Preview struct {
+	URL         string
+	Title       string
+	Description string
+	ImageURL    string
+}
+
+// Config is used to provide the limits of a Fetcher to the New function. Zero values are replaced by the defaults.
+type Config struct {
+	// Timeout is the maximum duration of a fetch, redirects included
+	Timeout time.Duration
+
+	// MaxSize is the maximum number of bytes read from a page. The metadata are in the head of the page, so larger
+	// pages are truncated rather than refused.
+	MaxSize int64
+
+	// CacheTTL is how long results (including failures) are kept; CacheSize is the maximum number of cached URLs
+	CacheTTL  time.Duration
+	CacheSize int
+
+	// AllowedNetworks are IP addresses or CIDR networks (e.g. "10.1.0.0/16") that can be fetched even if they are
+	// private or reserved, on any port
+	AllowedNetworks []string
+
+	// TLSConfig, if not nil, is used for https connections (e.g. to trust the certificate of httptest.NewTLSServer)
+	TLSConfig *tls.Config
+}
+
+// Fetcher fetches link previews. It is safe for concurrent use.
+type Fetcher struct {
+	client  *http.Client
+	maxSize int64
+	allowed []*net.IPNet
+	cache   *cache
+}
+
+// New returns a Fetcher with the given limits. It fails only if an entry of cfg.AllowedNetworks is not valid.
+func New(cfg Config) (*Fetcher, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.CacheTTL <= 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+
+	f := &Fetcher{
+		maxSize: cfg.MaxSize,
+		cache:   newCache(cfg.CacheSize, cfg.CacheTTL),
+	}
+	for _, n := range cfg.AllowedNetworks {
+		network, err := parseNetwork(n)
+		if err != nil {
+			return nil, err
+		}
+		f.allowed = append(f.allowed, network)
+	}
+
+	dialer := &net.Dialer{
+		Timeout: cfg.Timeout,
+		Control: f.checkAddress,
+	}
+	transport := &http.Transport{
+		// no proxy: the address check must see the real destination
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       cfg.TLSConfig,
+		TLSHandshakeTimeout:   cfg.Timeout,
+		ResponseHeaderTimeout: cfg.Timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return checkURL(req.URL)
+		},
+	}
+	return f, nil
+}
+
+// urlRx finds http and https URLs in a text
+var urlRx = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// FindURL returns the first http or https URL in text, without trailing punctuation, or an empty string.
+func FindURL(text string) string {
+	u := urlRx.FindString(text)
+	return strings.TrimRight(u, ".,;:!?)]}'")
+}
+
+// Fetch returns the preview of the page at rawURL. Results are cached, failures included.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (Preview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Preview{}, ErrInvalidURL
+	}
+	if err := checkURL(u); err != nil {
+		return Preview{}, err
+	}
+	u.Fragment = ""
+	key := u.String()
+
+	if p, err, ok := f.cache.get(key); ok {
+		return p, err
+	}
+	p, err := f.fetch(ctx, u)
+	// a cancelled fetch says nothing about the page
+	if ctx.Err() == nil {
+		f.cache.put(key, p, err)
+	}
+	return p, err
+}
+
+func (f *Fetcher) fetch(ctx context.Context, u *url.URL) (Preview, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Preview{}, ErrInvalidURL
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	req.Header.Set("User-Agent", "WASAText-LinkPreview/1.0")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Preview{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Preview{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+		return Preview{}, ErrNotHTML
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxSize))
+	if err != nil {
+		return Preview{}, err
+	}
+
+	// relative image URLs are resolved against the final URL, after redirects
+	p := parseHTML(string(body), resp.Request.URL)
+	if p.Title == "" && p.Description == "" {
+		return Preview{}, ErrNoMetadata
+	}
+	p.URL = u.String()
+	return p, nil
+}
+
+// checkURL accepts only absolute http and https URLs without credentials. Addresses and ports are checked when
+// dialing, by checkAddress.
+func checkURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return ErrInvalidURL
+	}
+	return nil
+}
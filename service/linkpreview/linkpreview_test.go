@@ -0,0 +1,185 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPage = `<html><head><title>Test page</title>` +
+	`<meta property="og:description" content="A page used in tests"></head><body></body></html>`
+
+// newTestServer starts an httptest.Server serving handler, and a Fetcher that can reach it through
+// Config.AllowedNetworks.
+func newTestServer(t *testing.T, cfg Config, handler http.HandlerFunc) (*httptest.Server, *Fetcher) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	cfg.AllowedNetworks = append(cfg.AllowedNetworks, "127.0.0.1")
+	f, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, f
+}
+
+func serveHTML(page string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv, f := newTestServer(t, Config{}, serveHTML(testPage))
+
+	p, err := f.Fetch(context.Background(), srv.URL+"/page#top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Preview{URL: srv.URL + "/page", Title: "Test page", Description: "A page used in tests"}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
+
+func TestFetchRefusesLoopbackNotAllowed(t *testing.T) {
+	srv := httptest.NewServer(serveHTML(testPage))
+	defer srv.Close()
+
+	f, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Fetch(context.Background(), srv.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got error %v, want %v", err, ErrForbiddenAddress)
+	}
+}
+
+func TestFetchRefusesPrivateAddresses(t *testing.T) {
+	f, err := New(Config{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the address is checked before connecting, so none of these is actually dialed
+	for _, u := range []string{
+		"http://10.0.0.1/",
+		"http://192.168.1.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/",
+		"http://100.64.0.1/",
+		"http://8.8.8.8:8080/", // public, but not on a standard port
+	} {
+		if _, err := f.Fetch(context.Background(), u); !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("%s: got error %v, want %v", u, err, ErrForbiddenAddress)
+		}
+	}
+}
+
+func TestFetchRefusesRedirectToPrivateAddress(t *testing.T) {
+	var target string
+	srv, f := newTestServer(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+	// same server, but on a loopback address that is not allowed
+	u, _ := url.Parse(srv.URL)
+	target = "http://127.0.0.2:" + u.Port() + "/"
+
+	if _, err := f.Fetch(context.Background(), srv.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("got error %v, want %v", err, ErrForbiddenAddress)
+	}
+}
+
+func TestFetchTruncatesAtMaxSize(t *testing.T) {
+	padding := strings.Repeat("<!-- padding -->", 100)
+	f, err := New(Config{MaxSize: 512, AllowedNetworks: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		page  string
+		title string
+		err   error
+	}{
+		{"head before the limit", testPage + padding, "Test page", nil},
+		{"head after the limit", "<html>" + padding + testPage[len("<html>"):], "", ErrNoMetadata},
+	} {
+		srv := httptest.NewServer(serveHTML(c.page))
+		p, err := f.Fetch(context.Background(), srv.URL)
+		srv.Close()
+		if !errors.Is(err, c.err) || p.Title != c.title {
+			t.Errorf("%s: got %q, %v, want %q, %v", c.name, p.Title, err, c.title, c.err)
+		}
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv, f := newTestServer(t, Config{Timeout: 100 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	start := time.Now()
+	_, err := f.Fetch(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("fetch of a stalled page succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("fetch took %s, the timeout is 100ms", elapsed)
+	}
+}
+
+func TestFetchCachesFailures(t *testing.T) {
+	var hits int32
+	srv, f := newTestServer(t, Config{}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.NotFound(w, r)
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, err := f.Fetch(context.Background(), srv.URL); err == nil {
+			t.Fatalf("fetch %d: a missing page succeeded", i)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("the page was requested %d times, want 1", n)
+	}
+}
+
+func TestFetchDoesNotCacheCancelledFetches(t *testing.T) {
+	srv, f := newTestServer(t, Config{}, serveHTML(testPage))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Fetch(ctx, srv.URL); err == nil {
+		t.Fatal("cancelled fetch succeeded")
+	}
+	if _, err := f.Fetch(context.Background(), srv.URL); err != nil {
+		t.Fatalf("fetch after a cancelled one failed: %v", err)
+	}
+}
+
+func TestFindURL(t *testing.T) {
+	for _, c := range []struct{ text, want string }{
+		{"see https://example.com/a?b=c.", "https://example.com/a?b=c"},
+		{"(http://example.com/x)", "http://example.com/x"},
+		{"no links here", ""},
+		{"ftp://example.com", ""},
+	} {
+		if got := FindURL(c.text); got != c.want {
+			t.Errorf("FindURL(%q) = %q, want %q", c.text, got, c.want)
+		}
+	}
+}